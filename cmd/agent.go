@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	tresor "github.com/helloworlddan/tresor/lib"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultAgentTTL = time.Minute * 10
+)
+
+var agentTTL time.Duration
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run an agent caching unlocked private keys.",
+	Long: `Run an agent caching unlocked private keys.
+
+While the agent is running, private keys unlocked by other tresor commands are
+kept in memory for the configured TTL ('agent_ttl', default 10m). The agent
+decrypts and signs with them, so other commands leave the keys locked. Keys and
+passphrases never leave the agent. It listens on 'agent_socket' (default
+$XDG_RUNTIME_DIR/tresor-agent.sock, or $HOME/.tresor-agent.sock if it is not
+set), which only you can access. Any process running as you can have the agent
+decrypt and sign while it holds a key, so keep the TTL short and lock the agent
+when you are done.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, err := agentSocketPath()
+		if err != nil {
+			fail(err)
+		}
+
+		ttl := agentTTL
+		if ttl == 0 {
+			ttl = viper.GetDuration("agent_ttl")
+		}
+		if ttl == 0 {
+			ttl = defaultAgentTTL
+		}
+
+		// Remove the socket when terminated
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			os.Remove(socket)
+			os.Exit(0)
+		}()
+
+		fmt.Fprintf(os.Stderr, "Agent listening on %s (TTL %v)\n", socket, ttl)
+		if err = tresor.ServeAgent(socket, ttl); err != nil {
+			fail(err)
+		}
+	},
+}
+
+var agentLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Wipe all unlocked private keys from the agent.",
+	Long:  `Wipe all unlocked private keys from the agent.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, err := agentSocketPath()
+		if err != nil {
+			fail(err)
+		}
+		if err = tresor.LockAgent(socket); err != nil {
+			fail(err)
+		}
+	},
+}
+
+// agentSocketPath returns the configured or default location of the agent socket. The runtime
+// directory is private to the user and cleared on logout, so it is preferred over the home directory.
+func agentSocketPath() (string, error) {
+	if socket := viper.GetString("agent_socket"); socket != "" {
+		return homedir.Expand(socket)
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "tresor-agent.sock"), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".tresor-agent.sock"), nil
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentLockCmd)
+	agentCmd.Flags().DurationVarP(&agentTTL, "ttl", "t", 0, "Time to keep unlocked keys in memory.")
+}
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 
+	"cloud.google.com/go/storage"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	tresor "github.com/helloworlddan/tresor/lib"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -17,19 +20,196 @@ var cpCmd = &cobra.Command{
 		if len(args) != 2 {
 			fail(fmt.Errorf("specify to keys: source and destination"))
 		}
-		sourceKey := args[0]
+		sourceKey, err := storageName(args[0])
+		if err != nil {
+			fail(err)
+		}
 		destinationKey := args[1]
 
-		if err := tresor.CopyObject(viper.Get("bucket").(string), sourceKey, destinationKey); err != nil {
-			fail(err)
+		// Record the copy in the index before storing it
+		if cachedIndex != nil {
+			destinationKey = cachedIndex.StorageName(args[1])
+			if _, known := cachedIndex.Lookup(args[1]); !known {
+				cachedIndex.Add(args[1])
+				if err = saveIndex(cachedIndex); err != nil {
+					fail(err)
+				}
+			}
 		}
 
-		if err := tresor.CopyMetadata(viper.Get("bucket").(string), sourceKey, destinationKey); err != nil {
+		bucket := viper.Get("bucket").(string)
+		generation, err := copyObject(bucket, args[0], sourceKey, args[1], destinationKey)
+		if err != nil {
+			fail(err)
+		}
+		stateErr := recordState(args[1], destinationKey, generation)
+		if err = appendAudit("cp", destinationKey, sourceKey, generation); err != nil {
 			fail(err)
 		}
+		if stateErr != nil {
+			fail(stateErr)
+		}
 	},
 }
 
+// copyObject copies an object to a new key. Objects with header are bound to their key, so they are
+// decrypted and encrypted again for the new key, to the same recipients. Other objects are copied as
+// they are. It returns the generation of the copy.
+func copyObject(bucket string, sourceName string, sourceKey string, destinationName string, destinationKey string) (int64, error) {
+	attrs, err := tresor.ReadMetadata(bucket, sourceKey, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var header *tresor.ObjectHeader
+	var plainBytes, encryptedBytes []byte
+	var signature *tresor.Signature
+	if attrs.Metadata["Symmetric"] != "true" {
+		decryptor, err := decryptionCrypto(attrs.Metadata)
+		if err != nil {
+			return 0, err
+		}
+		if encryptedBytes, err = tresor.ReadObject(bucket, sourceKey, attrs.Generation); err != nil {
+			return 0, err
+		}
+		if plainBytes, signature, err = decryptor.Decrypt(encryptedBytes); err != nil {
+			return 0, err
+		}
+		if err = checkSignerPin(signature); err != nil {
+			return 0, err
+		}
+		if header, plainBytes, err = tresor.UnwrapHeader(plainBytes); err != nil {
+			return 0, err
+		}
+		if err = checkObjectName(sourceName, header); err != nil {
+			return 0, err
+		}
+		if err = checkGeneration(sourceName, attrs, header); err != nil {
+			return 0, err
+		}
+	}
+
+	if header == nil {
+		generation, err := tresor.CopyObject(bucket, sourceKey, destinationKey)
+		if err != nil {
+			return 0, err
+		}
+		if err = tresor.CopyMetadata(bucket, sourceKey, destinationKey); err != nil {
+			return 0, err
+		}
+		return generation, nil
+	}
+
+	encryptor, meta, signer, err := copyCrypto(bucket, sourceName, destinationName, encryptedBytes, signature)
+	if err != nil {
+		return 0, err
+	}
+	generation, err := tresor.ObjectGeneration(bucket, destinationKey)
+	if err != nil {
+		return 0, err
+	}
+	header.Name = destinationName
+	header.Replaces = generation
+
+	if encryptedBytes, err = sealObject(encryptor, header, plainBytes); err != nil {
+		return 0, err
+	}
+	return storeObject(destinationName, destinationKey, encryptedBytes, meta, generation, signer)
+}
+
+// copyCrypto creates the encryption for the copy of an object, which is readable by the same
+// recipients and signed by the same signer as the source. Copies that would change either are refused.
+func copyCrypto(bucket string, sourceName string, destinationName string, encryptedBytes []byte, signature *tresor.Signature) (tresor.Crypto, storage.ObjectAttrsToUpdate, *openpgp.Entity, error) {
+	info, err := tresor.InspectPayload(bytes.NewReader(encryptedBytes))
+	if err != nil {
+		return nil, storage.ObjectAttrsToUpdate{}, nil, err
+	}
+	format, err := objectFormat(destinationName)
+	if err != nil {
+		return nil, storage.ObjectAttrsToUpdate{}, nil, err
+	}
+	if format != info.Format {
+		return nil, storage.ObjectAttrsToUpdate{}, nil, fmt.Errorf("%s is stored as %s, but %s is stored as %s. Use get and put to convert it", sourceName, info.Format, destinationName, format)
+	}
+
+	// Age recipients cannot be told from the stanzas, only their number
+	if format == tresor.FormatAge {
+		inspection, err := tresor.InspectMessage(bytes.NewReader(encryptedBytes), nil, false)
+		if err != nil {
+			return nil, storage.ObjectAttrsToUpdate{}, nil, err
+		}
+		stanzas := 0
+		for _, packet := range inspection.Packets {
+			if packet.Type == "Recipient Stanza" {
+				stanzas++
+			}
+		}
+		if configured := len(viper.GetStringSlice("age_recipients")); stanzas != configured {
+			return nil, storage.ObjectAttrsToUpdate{}, nil, fmt.Errorf("%s is encrypted to %d recipient(s), but %d are configured in age_recipients. Use get and put to store it for the configured recipients", sourceName, stanzas, configured)
+		}
+		encryptor, meta, err := encryptionCrypto(format)
+		return encryptor, meta, nil, err
+	}
+
+	if info.Symmetric {
+		return nil, storage.ObjectAttrsToUpdate{}, nil, fmt.Errorf("%s can also be decrypted with a passphrase, which cannot be copied. Use get and put to copy it", sourceName)
+	}
+	recipients, err := resolveKeyIDs(bucket, info.Recipients)
+	if err != nil {
+		return nil, storage.ObjectAttrsToUpdate{}, nil, fmt.Errorf("cannot copy %s to the same recipients: %v", sourceName, err)
+	}
+	if err = checkKeyPins(recipients...); err != nil {
+		return nil, storage.ObjectAttrsToUpdate{}, nil, err
+	}
+
+	// The copy is only signed if the source is, and only by the same key
+	var signer *openpgp.Entity
+	if signature != nil && signature.Signed {
+		if signer, err = loadSigner(); err != nil {
+			return nil, storage.ObjectAttrsToUpdate{}, nil, err
+		}
+		if signature.Fingerprint() != tresor.Fingerprint(signer) {
+			return nil, storage.ObjectAttrsToUpdate{}, nil, fmt.Errorf("%s is signed by %s, only they can copy it. Use get and put to store it signed by you", sourceName, signature.Identity())
+		}
+	}
+	encryptor, meta := recipientCrypto(recipients, signer)
+	return encryptor, meta, signer, nil
+}
+
+// resolveKeyIDs finds the keys an object is encrypted to among the configured keys and the keys
+// published in the vault
+func resolveKeyIDs(bucket string, keyIDs []uint64) (openpgp.EntityList, error) {
+	ring, err := cachedRing()
+	if err != nil {
+		return nil, err
+	}
+	published, err := tresor.PublishedKeys(bucket)
+	if err != nil {
+		return nil, err
+	}
+	candidates := append(openpgp.EntityList{}, ring...)
+	for _, key := range published {
+		candidates = append(candidates, key.Entity)
+	}
+
+	var recipients openpgp.EntityList
+	resolved := map[string]bool{}
+	for _, keyID := range keyIDs {
+		if keyID == 0 {
+			return nil, fmt.Errorf("a recipient is hidden")
+		}
+		keys := candidates.KeysById(keyID)
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("key %016X is neither configured nor published in the vault", keyID)
+		}
+		if fingerprint := tresor.Fingerprint(keys[0].Entity); !resolved[fingerprint] {
+			resolved[fingerprint] = true
+			recipients = append(recipients, keys[0].Entity)
+		}
+	}
+	return recipients, nil
+}
+
 func init() {
 	rootCmd.AddCommand(cpCmd)
 }
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+)
+
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Decrypt a local file.",
+	Long: `Decrypt a local file or STDIN, for example an object downloaded from a backup.
+
+The format is detected from the file, and signatures are verified against the
+signature policy and pinned keys like with get. Objects written by tresor are
+restored with their original mode and modification time when written to a
+file with --out. The key an object was stored under cannot be checked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 0 {
+			fail(fmt.Errorf("use --in to specify the file to decrypt"))
+		}
+
+		// Whether a passphrase is prompted for is only known once the input is read
+		encryptedBytes, err := readInput(localReadPath, false, false)
+		if err != nil {
+			fail(err)
+		}
+
+		// Select decryption like for stored objects, by what their metadata would record
+		info, err := tresor.InspectPayload(bytes.NewReader(encryptedBytes))
+		if err != nil {
+			fail(err)
+		}
+		metadata := map[string]string{"Format": info.Format}
+		if info.Symmetric && len(info.Recipients) == 0 {
+			metadata["Symmetric"] = "true"
+		}
+		decryptor, err := decryptionCrypto(metadata)
+		if err != nil {
+			fail(err)
+		}
+
+		plainBytes, signature, err := decryptor.Decrypt(encryptedBytes)
+		if err != nil {
+			fail(err)
+		}
+		if err = checkSignerPin(signature); err != nil {
+			fail(err)
+		}
+		header, plainBytes, err := tresor.UnwrapHeader(plainBytes)
+		if err != nil {
+			fail(err)
+		}
+
+		if localWritePath == "" {
+			os.Stdout.Write(plainBytes)
+		} else if err = writeOutput(localWritePath, header, plainBytes, true); err != nil {
+			fail(err)
+		}
+
+		if signature.Signed {
+			fmt.Fprintf(os.Stderr, "Signed by %s\n", signature.Identity())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(decryptCmd)
+	decryptCmd.Flags().StringVarP(&localReadPath, "in", "i", "", "Input file to read from.")
+	decryptCmd.Flags().StringVarP(&localWritePath, "out", "o", "", "Output file to write to.")
+}
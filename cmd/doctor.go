@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var doctorKeys bool
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the local configuration for problems.",
+	Long: `Check the local configuration for problems.
+
+With --keys, report the status of all configured keys: the recipient, private
+and signer keys, the keys in private_keyring, the index_recipients and the keys
+published in the vault. Pinned keys are recipients of other members and must be
+usable, unpinned published keys are only listed. Runs all checks if no check is
+selected.
+Exits with status code 1 if any problem is found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		all := !doctorKeys
+
+		healthy := true
+		if doctorKeys || all {
+			healthy = checkKeys() && healthy
+		}
+
+		if !healthy {
+			os.Exit(exitFailure)
+		}
+	},
+}
+
+// keySource is a set of keys doctor reports on, loaded on demand
+type keySource struct {
+	role     string
+	location string
+	load     func() (openpgp.EntityList, error)
+	encrypt  bool // Objects are encrypted to the keys
+}
+
+// checkKeys reports the status of every configured key and whether all of them are usable
+func checkKeys() bool {
+	var sources []keySource
+	addFile := func(role string, location string, encrypt bool) {
+		if location == "" {
+			return
+		}
+		sources = append(sources, keySource{role, location, func() (openpgp.EntityList, error) {
+			return tresor.LoadArmoredKeyRing(location)
+		}, encrypt})
+	}
+
+	addFile("recipient", viper.GetString("public_key"), true)
+	addFile("private", viper.GetString("private_key"), false)
+	for _, location := range viper.GetStringSlice("private_keys") {
+		addFile("private", location, false)
+	}
+	if directory := viper.GetString("private_keyring"); directory != "" {
+		sources = append(sources, keySource{"private", directory, func() (openpgp.EntityList, error) {
+			return tresor.LoadKeyRingDirectory(directory)
+		}, false})
+	}
+	for _, location := range viper.GetStringSlice("signer_keys") {
+		addFile("signer", location, false)
+	}
+
+	bucket := viper.GetString("bucket")
+	if bucket != "" {
+		for _, query := range viper.GetStringSlice("index_recipients") {
+			query := query
+			sources = append(sources, keySource{"index", query, func() (openpgp.EntityList, error) {
+				return resolveRecipients(bucket, []string{query})
+			}, true})
+		}
+	}
+
+	healthy := true
+	now := time.Now()
+	reported := map[string]bool{}
+	for _, source := range sources {
+		ring, err := source.load()
+		if err != nil {
+			fmt.Printf("%s\t%s\terror: %v\n", source.role, source.location, err)
+			healthy = false
+			continue
+		}
+		for _, entity := range ring {
+			healthy = reportKey(source.role, entity, source.encrypt, now) && healthy
+			reported[tresor.Fingerprint(entity)] = true
+		}
+	}
+
+	if bucket != "" {
+		healthy = checkPublishedKeys(bucket, reported, now) && healthy
+	}
+	return healthy
+}
+
+// checkPublishedKeys reports the keys published in the key directory of a vault. Pinned keys
+// are recipients of other members, so they must be usable. Pinned keys that are no longer
+// published and not configured locally are listed, they can't be found as recipients anymore.
+func checkPublishedKeys(bucket string, reported map[string]bool, now time.Time) bool {
+	pins, err := loadKeyPins()
+	if err != nil {
+		fmt.Printf("pinned\t%s\terror: %v\n", bucket, err)
+		return false
+	}
+	published, err := tresor.PublishedKeys(bucket)
+	if err != nil {
+		fmt.Printf("published\t%s\terror: %v\n", bucket, err)
+		return false
+	}
+
+	pinned := map[string]bool{}
+	for _, identity := range pins.Identities(bucket) {
+		fingerprint, _ := pins.Lookup(bucket, identity)
+		pinned[fingerprint] = true
+	}
+
+	healthy := true
+	for _, key := range published {
+		fingerprint := tresor.Fingerprint(key.Entity)
+		if pinned[fingerprint] {
+			healthy = reportKey("pinned", key.Entity, true, now) && healthy
+			delete(pinned, fingerprint)
+		} else {
+			reportKey("published", key.Entity, true, now)
+		}
+	}
+	var unpublished []string
+	for fingerprint := range pinned {
+		if !reported[fingerprint] {
+			unpublished = append(unpublished, fingerprint)
+		}
+	}
+	sort.Strings(unpublished)
+	for _, fingerprint := range unpublished {
+		fmt.Printf("pinned\t%s\tnot published\n", fingerprint)
+	}
+	return healthy
+}
+
+// reportKey prints the status of a key and whether it is usable
+func reportKey(role string, entity *openpgp.Entity, encrypt bool, now time.Time) bool {
+	status := tresor.CheckKey(entity, now)
+	expiry := "no expiry"
+	if !status.Expiry.IsZero() {
+		expiry = status.Expiry.Format("2006-01-02")
+	}
+	fmt.Printf("%s\t%s\t%s\t%s\t%s\n", role, tresor.Fingerprint(entity), status, expiry, tresor.PrimaryIdentity(entity))
+	return !status.Revoked && !status.Expired && (!encrypt || status.Encrypt)
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().BoolVarP(&doctorKeys, "keys", "k", false, "Report the status of all configured keys.")
+}
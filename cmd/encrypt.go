@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt a local file without storing it.",
+	Long: `Encrypt a local file or STDIN without storing it.
+
+The recipients, signing and armor settings of put are used, but nothing is
+read from or written to the bucket. The output is a plain OpenPGP message or
+age file without tresor's object header, so it can be decrypted with other
+tools, for example to send it by email.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 0 {
+			fail(fmt.Errorf("use --in to specify the file to encrypt"))
+		}
+
+		format, err := objectFormat("")
+		if err != nil {
+			fail(err)
+		}
+		if symmetricObject && format != tresor.FormatOpenPGP {
+			fail(fmt.Errorf("symmetric objects are only supported in the openpgp format"))
+		}
+		if symmetricPassFile != "" && !symmetricObject {
+			fail(fmt.Errorf("--passphrase-file requires --symmetric"))
+		}
+		signing := format == tresor.FormatOpenPGP && viper.Get("object_signing").(bool) && !symmetricObject
+
+		plainBytes, err := readInput(localReadPath, false, symmetricPrompt() || (signing && interactivePassphrase()))
+		if err != nil {
+			fail(err)
+		}
+
+		var encryptor tresor.Crypto
+		if symmetricObject {
+			encryptor, _, err = symmetricCrypto()
+		} else {
+			encryptor, _, err = encryptionCrypto(format)
+		}
+		if err != nil {
+			fail(err)
+		}
+		encryptedBytes, err := encryptor.Encrypt(plainBytes)
+		if err != nil {
+			fail(err)
+		}
+
+		if localWritePath == "" {
+			os.Stdout.Write(encryptedBytes)
+			return
+		}
+		if err = ioutil.WriteFile(localWritePath, encryptedBytes, 0644); err != nil {
+			fail(fmt.Errorf("failed to write output file: %v", err))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(encryptCmd)
+	encryptCmd.Flags().StringVarP(&localReadPath, "in", "i", "", "Input file to read from.")
+	encryptCmd.Flags().StringVarP(&localWritePath, "out", "o", "", "Output file to write to.")
+	encryptCmd.Flags().BoolVar(&symmetricObject, "symmetric", false, "Encrypt with a passphrase instead of the public key.")
+	encryptCmd.Flags().StringVar(&symmetricPassFile, "passphrase-file", "", "File to read the passphrase for --symmetric from, instead of prompting for it.")
+}
@@ -0,0 +1,680 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	stateUpdateAttempts = 5
+	stateRetryDelay     = 200 * time.Millisecond
+)
+
+var (
+	checkVaultState bool
+	repairMetadata  bool
+	initVaultState  bool
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [prefix]",
+	Short: "Check the consistency of the vault.",
+	Long: `Check the consistency of the vault.
+
+Every object matching the prefix is checked against its metadata without
+decrypting it: Format, Content-Type, whether ASCII-Armor matches the actual
+encoding, whether passphrase-only objects are marked as Symmetric and, for
+objects written by older versions, whether Encryption-Key names the keys the
+object is encrypted to. Signed metadata has to verify. With --repair, wrong
+metadata is rewritten and signed with the private key if 'object_signing' is
+enabled. The command exits with status 3 if any problem is left.
+
+With --state, all objects in the bucket are compared against the last signed
+state of the vault, which is kept if 'vault_state' is enabled. Added, removed
+and changed objects are reported, and the command exits with status 3 if the
+vault does not match its state. With --state --init, all objects are verified
+and a new state is signed over them, to start tracking an existing vault or to
+accept its current contents after checking the reported changes. With --state
+--repair, the reported changes are recorded in the current state after verifying
+added and changed objects, for example after a put or rm could not update it.
+Removed objects are dropped from the state, so check the audit log for them
+first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Check for correct number of arguments
+		if len(args) > 1 {
+			fail(fmt.Errorf("specify at most one prefix"))
+		}
+		bucket := viper.Get("bucket").(string)
+
+		if checkVaultState {
+			if len(args) > 0 {
+				fail(fmt.Errorf("--state checks the whole vault, omit the prefix"))
+			}
+			if repairMetadata && initVaultState {
+				fail(fmt.Errorf("--repair cannot be combined with --init"))
+			}
+			if initVaultState {
+				initState(bucket)
+				return
+			}
+			if repairMetadata {
+				repairState(bucket)
+				return
+			}
+			fsckState(bucket)
+			return
+		}
+		if initVaultState {
+			fail(fmt.Errorf("--init requires --state"))
+		}
+
+		var prefix string
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		fsckObjects(bucket, prefix)
+	},
+}
+
+// fsckObjects checks the metadata of all objects matching a prefix and repairs it if requested
+func fsckObjects(bucket string, prefix string) {
+	// Obfuscated names only match the prefix once they are resolved
+	query := prefix
+	if obfuscatedNames() {
+		if _, err := loadIndex(); err != nil {
+			fail(err)
+		}
+		query = ""
+	}
+	found, err := tresor.QueryStorage(bucket, query, false)
+	if err != nil {
+		fail(err)
+	}
+
+	checked, failed := 0, 0
+	for _, attrs := range found {
+		if !tresor.StateObjectName(attrs.Name) && attrs.Name != tresor.IndexObject {
+			continue
+		}
+		name := displayName(attrs.Name)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		checked++
+
+		problems, repaired, err := checkObjectMetadata(bucket, name, attrs)
+		if err != nil {
+			fail(err)
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		var repairErr error
+		if repairMetadata && repaired != nil {
+			repairErr = repairObjectMetadata(bucket, name, attrs, repaired)
+			if errors.Is(repairErr, tresor.ErrBadPassphrase) {
+				fail(repairErr)
+			}
+			if repairErr == nil {
+				if err = appendAudit("repair", attrs.Name, "", attrs.Generation); err != nil {
+					fail(err)
+				}
+			}
+		}
+		if repairMetadata && repaired != nil && repairErr == nil {
+			fmt.Printf("REPAIRED\t%s\n", name)
+		} else {
+			fmt.Printf("FAILED\t%s\n", name)
+			failed++
+		}
+		for _, problem := range problems {
+			fmt.Printf("\t%s\n", problem)
+		}
+		if repairMetadata && repaired == nil {
+			fmt.Printf("\tRepair\t\tnot possible, store the object again\n")
+		} else if repairErr != nil {
+			fmt.Printf("\tRepair\t\t%v\n", repairErr)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d object(s) checked, %d failed\n", checked, failed)
+	if failed > 0 {
+		os.Exit(exitVerificationFailed)
+	}
+}
+
+// checkObjectMetadata compares the metadata of an object against its packets. It returns the
+// problems found and the metadata derived from the packets that would fix them, which is nil if
+// they cannot be fixed.
+func checkObjectMetadata(bucket string, name string, attrs *storage.ObjectAttrs) ([]string, map[string]string, error) {
+	reader, err := tresor.OpenObject(bucket, attrs.Name, attrs.Generation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	defer reader.Close()
+	info, err := tresor.InspectPayload(reader)
+	if err != nil {
+		return []string{fmt.Sprintf("Content\t\t%v", err)}, nil, nil
+	}
+
+	var problems []string
+	if len(attrs.Metadata) == 0 {
+		problems = append(problems, "Metadata\tmissing")
+	}
+	expected := derivedMetadata(info)
+	expect := func(key string, description string) {
+		if current, ok := attrs.Metadata[key]; ok && current != expected[key] {
+			problems = append(problems, fmt.Sprintf("%s\t%s, but %s", key, current, description))
+		} else if !ok && len(attrs.Metadata) > 0 {
+			problems = append(problems, fmt.Sprintf("%s\tmissing, %s", key, description))
+		}
+	}
+
+	expect("Format", "object is "+info.Format)
+	if info.Armored {
+		expect("ASCII-Armor", "object is armored")
+	} else {
+		expect("ASCII-Armor", "object is binary")
+	}
+	if contentType := encryptedContentType(info.Format); attrs.ContentType != contentType {
+		problems = append(problems, fmt.Sprintf("Content-Type\t%s instead of %s", attrs.ContentType, contentType))
+	}
+
+	repairable := true
+	symmetric := expected["Symmetric"] == "true"
+	if symmetric {
+		expect("Symmetric", "object is encrypted with a passphrase only")
+	} else if _, ok := attrs.Metadata["Symmetric"]; ok {
+		problems = append(problems, "Symmetric\tset, but object is encrypted to keys")
+	}
+
+	// Objects from older versions name their recipients, newer ones keep them in the encrypted header
+	if current, ok := attrs.Metadata["Encryption-Key"]; ok && info.Format == tresor.FormatOpenPGP {
+		keys, err := recipientKeyIDs(info, symmetric)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Encryption-Key\tcannot be checked, %v", err))
+		} else if !sameKeyIDs(current, keys) {
+			problems = append(problems, fmt.Sprintf("Encryption-Key\t%s, but object is encrypted to %s", current, keys))
+		}
+	}
+
+	// Tampered metadata is left as evidence, the object has to be stored again
+	if _, err = checkMetadata(name, attrs, nil); err != nil {
+		problems = append(problems, fmt.Sprintf("Signature\t%v", err))
+		repairable = false
+	} else if _, signed := attrs.Metadata[tresor.MetadataSignature]; !signed && info.Format == tresor.FormatOpenPGP && !symmetric {
+		// Only the content tells whether unsigned metadata should have been signed
+		signature, err := contentSignature(bucket, attrs, expected)
+		if errors.Is(err, tresor.ErrBadPassphrase) {
+			return nil, nil, err
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Signature\tmissing, content cannot be verified: %v", err))
+			repairable = false
+		} else if signature.Signed {
+			problems = append(problems, fmt.Sprintf("Signature\tmissing, but the content is signed by %s", signature.Identity()))
+		}
+	}
+
+	if !repairable {
+		return problems, nil, nil
+	}
+	return problems, expected, nil
+}
+
+// derivedMetadata creates the metadata tresor would store for an object from what its packets tell.
+// Algorithms inside the encrypted data and details of older versions are left out.
+func derivedMetadata(info *tresor.PayloadInfo) map[string]string {
+	metadata := map[string]string{
+		"Format":      info.Format,
+		"ASCII-Armor": strconv.FormatBool(info.Armored),
+	}
+	if info.Format != tresor.FormatOpenPGP {
+		return metadata
+	}
+	if info.Symmetric && len(info.Recipients) == 0 {
+		metadata["Symmetric"] = "true"
+	} else if strings.HasPrefix(info.Integrity, "AEAD") {
+		metadata["Integrity"] = "AEAD"
+	} else {
+		metadata["Integrity"] = info.Integrity
+	}
+	return metadata
+}
+
+// encryptedContentType returns the Content-Type of objects in a format
+func encryptedContentType(format string) string {
+	if format == tresor.FormatAge {
+		return "application/age-encryption"
+	}
+	return "application/pgp-encrypted"
+}
+
+// contentSignature decrypts an object to verify the signature on its content. The decryption is
+// selected by the metadata given, not by the stored one.
+func contentSignature(bucket string, attrs *storage.ObjectAttrs, metadata map[string]string) (*tresor.Signature, error) {
+	decryptor, err := decryptionCrypto(metadata)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := tresor.OpenObject(bucket, attrs.Name, attrs.Generation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	defer reader.Close()
+
+	report, err := decryptor.Verify(reader, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	return report.Signature, checkSignerPin(report.Signature)
+}
+
+// recipientKeyIDs lists the primary key IDs of the recipients of an object as older versions
+// recorded them in Encryption-Key
+func recipientKeyIDs(info *tresor.PayloadInfo, symmetric bool) (string, error) {
+	if symmetric {
+		return tresor.SymmetricKeyID, nil
+	}
+	ring, err := cachedRing()
+	if err != nil {
+		return "", err
+	}
+
+	var keys []string
+	for _, keyID := range info.Recipients {
+		found := ring.KeysById(keyID)
+		if len(found) == 0 {
+			return "", fmt.Errorf("recipient %016X is unknown", keyID)
+		}
+		keys = append(keys, found[0].Entity.PrimaryKey.KeyIdString())
+	}
+	return strings.Join(keys, ","), nil
+}
+
+// sameKeyIDs compares comma separated key IDs regardless of their order and case
+func sameKeyIDs(a string, b string) bool {
+	split := func(value string) []string {
+		keys := strings.Split(strings.ToUpper(value), ",")
+		sort.Strings(keys)
+		return keys
+	}
+	return strings.Join(split(a), ",") == strings.Join(split(b), ",")
+}
+
+// repairObjectMetadata replaces the metadata of an object with metadata derived from its packets.
+// Metadata of signed content is signed again, which only the signer of the content can do.
+func repairObjectMetadata(bucket string, name string, attrs *storage.ObjectAttrs, metadata map[string]string) error {
+	meta := storage.ObjectAttrsToUpdate{ContentType: encryptedContentType(metadata["Format"]), Metadata: metadata}
+
+	if metadata["Format"] == tresor.FormatOpenPGP && metadata["Symmetric"] != "true" {
+		signature, err := contentSignature(bucket, attrs, metadata)
+		if err != nil {
+			return fmt.Errorf("content cannot be verified: %w", err)
+		}
+		if signature.Signed {
+			signer, err := loadSigner()
+			if err != nil {
+				return err
+			}
+			if signature.Fingerprint() != tresor.Fingerprint(signer) {
+				return fmt.Errorf("content is signed by %s, only they can sign its metadata", signature.Identity())
+			}
+			if err = tresor.SignMetadata(signer, name, attrs.Generation, &meta, cryptoSettings()); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Updates only add or replace metadata, so keys to be dropped have to be cleared first
+	for key := range attrs.Metadata {
+		if _, ok := meta.Metadata[key]; !ok {
+			err := tresor.WriteMetadata(bucket, attrs.Name, storage.ObjectAttrsToUpdate{Metadata: map[string]string{}})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return tresor.WriteMetadata(bucket, attrs.Name, meta)
+}
+
+// fsckState compares the bucket against the signed state of the vault
+func fsckState(bucket string) {
+	state, generation, err := tresor.ReadVaultState(bucket)
+	if err != nil {
+		fail(err)
+	}
+	if generation == 0 {
+		fail(fmt.Errorf("vault has no state. Enable 'vault_state' and run 'tresor fsck --state --init' to create it"))
+	}
+	signature, err := checkState(state)
+	if err != nil {
+		fmt.Printf("FAILED\t%s\n\tError\t\t%v\n", tresor.StateObject, err)
+		os.Exit(exitVerificationFailed)
+	}
+	if obfuscatedNames() {
+		if _, err = loadIndex(); err != nil {
+			fail(err)
+		}
+	}
+	fmt.Printf("State\t\t%s\n", state.Root)
+	fmt.Printf("Signed\t\t%s, %s\n", state.Time.Local(), signature.Identity())
+
+	differences, err := compareState(bucket, state)
+	if err != nil {
+		fail(err)
+	}
+	for _, difference := range differences {
+		fmt.Println(difference.problem)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d object(s) in state, %d problem(s)\n", len(state.Leaves), len(differences))
+	if len(differences) > 0 {
+		os.Exit(exitVerificationFailed)
+	}
+}
+
+// initState verifies all objects in the bucket and signs a new state over them, replacing the
+// current one. Nothing is written if any object fails verification.
+func initState(bucket string) {
+	if !trackingState() {
+		fail(fmt.Errorf("enable 'vault_state' to keep the state up to date"))
+	}
+	if obfuscatedNames() {
+		if _, err := loadIndex(); err != nil {
+			fail(err)
+		}
+	}
+	generation, err := tresor.ObjectGeneration(bucket, tresor.StateObject)
+	if err != nil {
+		fail(err)
+	}
+	attrs, err := tresor.QueryStorage(bucket, "", false)
+	if err != nil {
+		fail(err)
+	}
+
+	state := &tresor.VaultState{}
+	failed := 0
+	for _, attr := range attrs {
+		if !tresor.StateObjectName(attr.Name) {
+			continue
+		}
+		report, err := verifyObject(bucket, attr)
+		if errors.Is(err, tresor.ErrBadPassphrase) {
+			fail(err)
+		}
+		if err != nil {
+			printReport(displayName(attr.Name), report, err)
+			failed++
+			continue
+		}
+		hash, err := hashObject(bucket, attr.Name, attr.Generation)
+		if err != nil {
+			fail(err)
+		}
+		state.Set(attr.Name, attr.Generation, hash)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d object(s) failed verification, vault state not written\n", failed)
+		os.Exit(exitVerificationFailed)
+	}
+
+	signer, err := loadSigner()
+	if err != nil {
+		fail(err)
+	}
+	if err = state.Sign(signer, cryptoSettings()); err != nil {
+		fail(err)
+	}
+	if err = tresor.WriteVaultState(bucket, state, generation); err != nil {
+		fail(fmt.Errorf("failed to write vault state, it may have been changed concurrently: %v", err))
+	}
+	if err = appendAudit("state", tresor.StateObject, "", 0); err != nil {
+		fail(err)
+	}
+	fmt.Printf("State\t\t%s\n", state.Root)
+	fmt.Fprintf(os.Stderr, "%d object(s) in state\n", len(state.Leaves))
+}
+
+// repairState records the differences between the bucket and the signed state of the vault, after
+// a change could not be recorded. Added and changed objects are verified first, and nothing is
+// written if any of them fails verification.
+func repairState(bucket string) {
+	if !trackingState() {
+		fail(fmt.Errorf("enable 'vault_state' to keep the state up to date"))
+	}
+	state, generation, err := tresor.ReadVaultState(bucket)
+	if err != nil {
+		fail(err)
+	}
+	if generation == 0 {
+		fail(fmt.Errorf("vault has no state. Run 'tresor fsck --state --init' to create it"))
+	}
+	if _, err = checkState(state); err != nil {
+		fmt.Printf("FAILED\t%s\n\tError\t\t%v\n", tresor.StateObject, err)
+		os.Exit(exitVerificationFailed)
+	}
+	if obfuscatedNames() {
+		if _, err = loadIndex(); err != nil {
+			fail(err)
+		}
+	}
+
+	differences, err := compareState(bucket, state)
+	if err != nil {
+		fail(err)
+	}
+	var updated []tresor.StateLeaf
+	var removed []tresor.StateLeaf
+	failed := 0
+	for _, difference := range differences {
+		if difference.attrs == nil {
+			fmt.Println(difference.problem)
+			removed = append(removed, difference.leaf)
+			continue
+		}
+		report, err := verifyObject(bucket, difference.attrs)
+		if errors.Is(err, tresor.ErrBadPassphrase) {
+			fail(err)
+		}
+		if err != nil {
+			printReport(displayName(difference.attrs.Name), report, err)
+			failed++
+			continue
+		}
+		hash, err := hashObject(bucket, difference.attrs.Name, difference.attrs.Generation)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(difference.problem)
+		updated = append(updated, tresor.StateLeaf{Name: difference.attrs.Name, Generation: difference.attrs.Generation, Hash: hash})
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d object(s) failed verification, vault state not written\n", failed)
+		os.Exit(exitVerificationFailed)
+	}
+	if len(differences) == 0 {
+		fmt.Fprintf(os.Stderr, "%d object(s) in state, nothing to repair\n", len(state.Leaves))
+		return
+	}
+
+	// Objects changed again in the meantime are already recorded with a newer generation
+	err = updateState(func(state *tresor.VaultState) {
+		for _, leaf := range updated {
+			if current, ok := state.Leaf(leaf.Name); !ok || current.Generation <= leaf.Generation {
+				state.Set(leaf.Name, leaf.Generation, leaf.Hash)
+			}
+		}
+		for _, leaf := range removed {
+			if current, ok := state.Leaf(leaf.Name); ok && current.Generation == leaf.Generation {
+				state.Remove(leaf.Name)
+			}
+		}
+	})
+	if err != nil {
+		fail(err)
+	}
+	if err = appendAudit("state", tresor.StateObject, "", 0); err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d change(s) recorded in the vault state\n", len(differences))
+}
+
+// stateDifference is an object that differs from the signed state of the vault
+type stateDifference struct {
+	attrs   *storage.ObjectAttrs // Nil for removed objects
+	leaf    tresor.StateLeaf     // Empty for added objects
+	problem string
+}
+
+// compareState hashes all objects in the bucket and describes how they differ from the state
+func compareState(bucket string, state *tresor.VaultState) ([]stateDifference, error) {
+	attrs, err := tresor.QueryStorage(bucket, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := map[string]tresor.StateLeaf{}
+	for _, leaf := range state.Leaves {
+		leaves[leaf.Name] = leaf
+	}
+
+	var differences []stateDifference
+	for _, attr := range attrs {
+		if !tresor.StateObjectName(attr.Name) {
+			continue
+		}
+		name := displayName(attr.Name)
+		leaf, ok := leaves[attr.Name]
+		if !ok {
+			differences = append(differences, stateDifference{attrs: attr, problem: fmt.Sprintf("ADDED\t%s", name)})
+			continue
+		}
+		delete(leaves, attr.Name)
+
+		if attr.Generation != leaf.Generation {
+			problem := fmt.Sprintf("CHANGED\t%s, generation %d instead of %d", name, attr.Generation, leaf.Generation)
+			differences = append(differences, stateDifference{attrs: attr, leaf: leaf, problem: problem})
+			continue
+		}
+		hash, err := hashObject(bucket, attr.Name, attr.Generation)
+		if err != nil {
+			return nil, err
+		}
+		if hash != leaf.Hash {
+			problem := fmt.Sprintf("CHANGED\t%s, content does not match", name)
+			differences = append(differences, stateDifference{attrs: attr, leaf: leaf, problem: problem})
+		}
+	}
+
+	for _, leaf := range state.Leaves {
+		if _, missing := leaves[leaf.Name]; missing {
+			differences = append(differences, stateDifference{leaf: leaf, problem: fmt.Sprintf("REMOVED\t%s", displayName(leaf.Name))})
+		}
+	}
+	return differences, nil
+}
+
+// checkState verifies the signature over the state against the signature policy
+func checkState(state *tresor.VaultState) (*tresor.Signature, error) {
+	ring, err := cachedRing()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := state.Verify(ring)
+	if err != nil {
+		return nil, err
+	}
+	if signature.Signer == nil {
+		return nil, fmt.Errorf("vault state is signed by unknown key %016X, add it to 'signer_keys'", signature.KeyID)
+	}
+	if err = signaturePolicy("").Verify(signature); err != nil {
+		return nil, fmt.Errorf("vault state: %v", err)
+	}
+	return signature, checkSignerPin(signature)
+}
+
+// trackingState reports whether the vault keeps a signed state of all objects
+func trackingState() bool {
+	return viper.GetBool("vault_state")
+}
+
+// updateState applies a change to the state of the vault and signs it, if enabled. The state has
+// to be signed correctly before. Concurrent changes are retried on the new state.
+func updateState(change func(state *tresor.VaultState)) error {
+	if !trackingState() {
+		return nil
+	}
+	bucket := viper.Get("bucket").(string)
+
+	signer, err := loadSigner()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < stateUpdateAttempts; attempt++ {
+		state, generation, err := tresor.ReadVaultState(bucket)
+		if err != nil {
+			return err
+		}
+		if generation != 0 {
+			if _, err = checkState(state); err != nil {
+				return fmt.Errorf("refusing to update vault state: %v", err)
+			}
+		}
+
+		change(state)
+		if err = state.Sign(signer, cryptoSettings()); err != nil {
+			return err
+		}
+		err = tresor.WriteVaultState(bucket, state, generation)
+		if tresor.IsConflict(err) {
+			// Back off, so concurrent writers do not collide again
+			time.Sleep(time.Duration(attempt+1)*stateRetryDelay + time.Duration(rand.Int63n(int64(stateRetryDelay))))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write vault state: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to write vault state: too many concurrent changes")
+}
+
+// stateNotUpdated explains how to record a change to an object after the vault state could not be
+// updated. The object itself is changed already.
+func stateNotUpdated(name string, err error) error {
+	return fmt.Errorf("%s was changed, but the vault state was not updated: %v. Run 'tresor fsck --repair --state' to record the change", name, err)
+}
+
+// hashObject hashes the stored bytes of a generation of an object
+func hashObject(bucket string, key string, generation int64) (string, error) {
+	reader, err := tresor.OpenObject(bucket, key, generation)
+	if err != nil {
+		return "", fmt.Errorf("failed to read object: %v", err)
+	}
+	defer reader.Close()
+	return tresor.HashCiphertext(reader)
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+	fsckCmd.Flags().BoolVar(&checkVaultState, "state", false, "Compare the bucket against the signed state of the vault.")
+	fsckCmd.Flags().BoolVar(&repairMetadata, "repair", false, "Rewrite wrong metadata, or record changes in the vault state with --state.")
+	fsckCmd.Flags().BoolVar(&initVaultState, "init", false, "Verify all objects and sign a new state over them, with --state.")
+}
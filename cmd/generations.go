@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	tresor "github.com/helloworlddan/tresor/lib"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+var cachedGenerations *tresor.GenerationLog
+
+// checkObjectName makes sure an object is stored under the key it was written for
+func checkObjectName(name string, header *tresor.ObjectHeader) error {
+	if header != nil && header.Name != "" && header.Name != name {
+		return fmt.Errorf("object %s was written for %s, it may have been swapped", name, header.Name)
+	}
+	return nil
+}
+
+// checkGeneration warns if the latest version of an object is older than the one seen before,
+// and otherwise records it as seen
+func checkGeneration(name string, attrs *storage.ObjectAttrs, header *tresor.ObjectHeader) error {
+	err := checkRollback(name, attrs, header)
+	var rollback *tresor.RollbackError
+	if errors.As(err, &rollback) {
+		warnRollback(rollback)
+		return nil
+	}
+	return err
+}
+
+// checkRollback fails with a RollbackError if the latest version of an object is older than the
+// one seen before, and otherwise records it as seen
+func checkRollback(name string, attrs *storage.ObjectAttrs, header *tresor.ObjectHeader) error {
+	generations, err := loadGenerations()
+	if err != nil {
+		return err
+	}
+
+	err = generations.Check(viper.Get("bucket").(string), name, attrs.Generation, header)
+	var rollback *tresor.RollbackError
+	if errors.As(err, &rollback) && rollback.Generation > rollback.Seen && storedAfterRemoval(attrs, rollback.Seen) {
+		return recordGeneration(name, attrs.Generation)
+	}
+	if err != nil {
+		// Keep the generation seen before, so the rollback is reported until the object is replaced
+		return err
+	}
+	return recordGeneration(name, attrs.Generation)
+}
+
+// storedAfterRemoval tells whether a signed record shows that the current generation of an object
+// was stored by a trusted signer: the vault state, or an audit log recording the removal of the
+// generation seen before and the new generation
+func storedAfterRemoval(attrs *storage.ObjectAttrs, seen int64) bool {
+	bucket := viper.Get("bucket").(string)
+
+	if trackingState() {
+		state, generation, err := tresor.ReadVaultState(bucket)
+		if err == nil && generation != 0 {
+			leaf, ok := state.Leaf(attrs.Name)
+			if _, err = checkState(state); err == nil && ok && leaf.Generation == attrs.Generation {
+				return true
+			}
+		}
+	}
+
+	if auditing() {
+		records, err := tresor.ReadAuditLog(bucket)
+		if err != nil {
+			return false
+		}
+		removed := false
+		var previous *tresor.AuditRecord
+		for _, record := range records {
+			if _, err = verifyAuditRecord(record, previous); err != nil {
+				return false
+			}
+			previous = record
+
+			entry := record.Entry
+			if entry.Key != attrs.Name {
+				continue
+			}
+			switch entry.Action {
+			case "rm":
+				removed = entry.Generation >= seen
+			case "put", "cp":
+				if removed && entry.Generation == attrs.Generation {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// recordDeletion records the generation of a removed object
+func recordDeletion(name string, generation int64) error {
+	generations, err := loadGenerations()
+	if err != nil {
+		return err
+	}
+	generations.RecordDeletion(viper.Get("bucket").(string), name, generation)
+	return generations.Save()
+}
+
+// recordGeneration records a generation of an object as seen
+func recordGeneration(name string, generation int64) error {
+	generations, err := loadGenerations()
+	if err != nil {
+		return err
+	}
+	generations.Record(viper.Get("bucket").(string), name, generation)
+	return generations.Save()
+}
+
+func loadGenerations() (*tresor.GenerationLog, error) {
+	if cachedGenerations != nil {
+		return cachedGenerations, nil
+	}
+	location, err := generationLogPath()
+	if err != nil {
+		return nil, err
+	}
+	if cachedGenerations, err = tresor.LoadGenerationLog(location); err != nil {
+		return nil, err
+	}
+	return cachedGenerations, nil
+}
+
+func warnRollback(rollback *tresor.RollbackError) {
+	fmt.Fprintln(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintf(os.Stderr, "WARNING: %s MAY HAVE BEEN ROLLED BACK!\n", rollback.Key)
+	fmt.Fprintln(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintf(os.Stderr, "%v\n", rollback)
+	fmt.Fprintln(os.Stderr, "Someone may have restored an old version. Check the history of")
+	fmt.Fprintln(os.Stderr, "the object with 'tresor info' before using it.")
+}
+
+// generationLogPath returns the configured or default location of the generation log
+func generationLogPath() (string, error) {
+	if location := viper.GetString("generation_log"); location != "" {
+		return homedir.Expand(location)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".tresor-generations.json"), nil
+}
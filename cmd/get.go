@@ -2,18 +2,27 @@ package cmd
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	tresor "github.com/helloworlddan/tresor/lib"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"golang.org/x/crypto/openpgp"
 )
 
 var (
-	localWritePath string
-	objectVersion  int64
+	localWritePath     string
+	objectVersion      int64
+	originalNameOutput bool
+	forceOverwrite     bool
+)
+
+var (
+	cachedKeyRing    openpgp.EntityList
+	cachedIdentities []age.Identity
 )
 
 var getCmd = &cobra.Command{
@@ -25,40 +34,253 @@ var getCmd = &cobra.Command{
 		if len(args) != 1 {
 			fail(fmt.Errorf("no object key specified"))
 		}
-		key := args[0]
+		if originalNameOutput && localWritePath != "" {
+			fail(fmt.Errorf("--out and --original-name are mutually exclusive"))
+		}
+		key, err := storageName(args[0])
+		if err != nil {
+			fail(err)
+		}
+
+		// Read remote metadata
+		attrs, err := tresor.ReadMetadata(viper.Get("bucket").(string), key, objectVersion)
+		if err != nil {
+			fail(err)
+		}
 
-		recipient, err := tresor.LoadArmoredKey(viper.Get("private_key").(string))
+		// Select decryption by object format
+		decryptor, err := decryptionCrypto(attrs.Metadata)
 		if err != nil {
 			fail(err)
 		}
 
 		// Read remote object
-		encryptedBytes, err := tresor.ReadObject(viper.Get("bucket").(string), key, objectVersion)
+		encryptedBytes, err := tresor.ReadObject(viper.Get("bucket").(string), key, attrs.Generation)
 		if err != nil {
 			fail(err)
 		}
 
-		// Decrypt data
-		plainBytes, err := tresor.DecryptBytes(openpgp.EntityList{recipient}, encryptedBytes)
+		// Decrypt data and verify signature
+		plainBytes, signature, err := decryptor.Decrypt(encryptedBytes)
 		if err != nil {
 			fail(err)
 		}
+		if err = checkSignerPin(signature); err != nil {
+			fail(err)
+		}
+		if _, err = checkMetadata(args[0], attrs, signature); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(exitVerificationFailed)
+		}
+
+		// Check content against the encrypted header
+		header, plainBytes, err := tresor.UnwrapHeader(plainBytes)
+		if err != nil {
+			fail(err)
+		}
+		if err = checkObjectName(args[0], header); err != nil {
+			fail(err)
+		}
+		if objectVersion == 0 {
+			if err = checkGeneration(args[0], attrs, header); err != nil {
+				fail(err)
+			}
+		}
 
 		// Dump to STDOUT if no file specified
-		if localWritePath == "" {
+		if originalNameOutput {
+			filename, err := originalName(args[0], header, attrs.Metadata)
+			if err != nil {
+				fail(err)
+			}
+			if err = writeOutput(filename, header, plainBytes, forceOverwrite); err != nil {
+				fail(err)
+			}
+			fmt.Fprintf(os.Stderr, "Written to %s\n", filename)
+		} else if localWritePath == "" {
 			fmt.Printf("%s", string(plainBytes))
 			fmt.Fprintln(os.Stderr) // Print newline to STDERR to get prompt break right
-			return
+		} else if err = writeOutput(localWritePath, header, plainBytes, true); err != nil {
+			fail(err)
 		}
 
-		if err = ioutil.WriteFile(localWritePath, plainBytes, 0644); err != nil {
-			fail(err)
+		if signature.Signed {
+			fmt.Fprintf(os.Stderr, "Signed by %s\n", signature.Identity())
 		}
 	},
 }
 
+// writeOutput writes decrypted content to a local file. Files are only readable by the owner,
+// unless the header records the original mode. The original modification time is restored.
+func writeOutput(location string, header *tresor.ObjectHeader, plainBytes []byte, overwrite bool) error {
+	mode := os.FileMode(0600)
+	if header != nil && header.Mode != 0 {
+		mode = header.Mode
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(location, flags, mode)
+	if os.IsExist(err) {
+		return fmt.Errorf("refusing to overwrite %s, use --force", location)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %v", err)
+	}
+	// The mode of existing files and the umask do not apply
+	if err = file.Chmod(mode); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to set file mode: %v", err)
+	}
+	if _, err = file.Write(plainBytes); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write output file: %v", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %v", err)
+	}
+
+	if header != nil && !header.ModTime.IsZero() {
+		if err = os.Chtimes(location, header.ModTime, header.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time: %v", err)
+		}
+	}
+	return nil
+}
+
+// originalName returns the file name to write an object to in the current directory: the original
+// filename, or the last part of the key with the original extension
+func originalName(name string, header *tresor.ObjectHeader, metadata map[string]string) (string, error) {
+	filename := path.Base(name)
+	if header != nil && header.Filename != "" {
+		filename = header.Filename
+	} else if header != nil && header.Extension != "" {
+		filename += header.Extension
+	} else if extension := metadata["File-Extension"]; extension != "" && extension != "null" {
+		filename += extension
+	}
+
+	// Never write outside the current directory
+	filename = filepath.Base(filepath.FromSlash(filename))
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid original filename: %s", filename)
+	}
+	return filename, nil
+}
+
+// decryptionCrypto selects the decryption for an object by the format recorded in its metadata.
+// Keys are only loaded once, so they are unlocked once for many objects.
+func decryptionCrypto(metadata map[string]string) (tresor.Crypto, error) {
+	policy := signaturePolicy(metadata["Signing-Key"])
+
+	// Passphrase-only objects need no keys
+	if metadata["Symmetric"] == "true" {
+		return &tresor.OpenPGPCrypto{Policy: policy}, nil
+	}
+
+	switch format := tresor.ObjectFormat(metadata); format {
+	case tresor.FormatOpenPGP:
+		ring, err := cachedRing()
+		if err != nil {
+			return nil, err
+		}
+		return &tresor.OpenPGPCrypto{Ring: ring, Policy: policy}, nil
+	case tresor.FormatAge:
+		if cachedIdentities == nil {
+			identities, err := tresor.LoadAgeIdentities(viper.GetStringSlice("age_identities"))
+			if err != nil {
+				return nil, err
+			}
+			cachedIdentities = identities
+		}
+		return &tresor.AgeCrypto{Identities: cachedIdentities, Policy: policy}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// cachedRing loads the key ring once
+func cachedRing() (openpgp.EntityList, error) {
+	if cachedKeyRing == nil {
+		ring, err := loadKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		cachedKeyRing = ring
+	}
+	return cachedKeyRing, nil
+}
+
+// loadKeyRing collects all configured private keys and the public keys of signers
+func loadKeyRing() (openpgp.EntityList, error) {
+	ring, err := loadPrivateKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	locations := viper.GetStringSlice("signer_keys")
+	if location := viper.GetString("public_key"); location != "" {
+		locations = append([]string{location}, locations...)
+	}
+
+	for _, location := range locations {
+		keys, err := tresor.LoadArmoredKeyRing(location)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	return ring, nil
+}
+
+// signaturePolicy builds the configured verification policy for an object
+func signaturePolicy(signingKey string) *tresor.SignaturePolicy {
+	return &tresor.SignaturePolicy{
+		RequireSignature: viper.GetBool("require_signature"),
+		TrustedSigners:   viper.GetStringSlice("trusted_signers"),
+		SigningKey:       signingKey,
+	}
+}
+
+// loadPrivateKeyRing collects all configured private keys usable for decryption
+func loadPrivateKeyRing() (openpgp.EntityList, error) {
+	var ring openpgp.EntityList
+
+	locations := viper.GetStringSlice("private_keys")
+	if location := viper.GetString("private_key"); location != "" {
+		locations = append([]string{location}, locations...)
+	}
+
+	for _, location := range locations {
+		keys, err := tresor.LoadArmoredKeyRing(location)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	if directory := viper.GetString("private_keyring"); directory != "" {
+		keys, err := tresor.LoadKeyRingDirectory(directory)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	if len(ring) == 0 {
+		return nil, fmt.Errorf("no private keys configured. Set 'private_key', 'private_keys' or 'private_keyring'")
+	}
+
+	return ring, nil
+}
+
 func init() {
 	rootCmd.AddCommand(getCmd)
 	getCmd.Flags().StringVarP(&localWritePath, "out", "o", "", "Output file to write to.")
+	getCmd.Flags().BoolVarP(&originalNameOutput, "original-name", "O", false, "Write to the original filename in the current directory.")
+	getCmd.Flags().BoolVar(&forceOverwrite, "force", false, "Overwrite an existing file with --original-name.")
 	getCmd.Flags().Int64VarP(&objectVersion, "version", "v", 0, "Version of the object to get.")
 }
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/viper"
+)
+
+var (
+	cachedIndex           *tresor.NameIndex
+	cachedIndexGeneration int64
+)
+
+// obfuscatedNames reports whether the vault stores objects under keyed-HMAC names
+func obfuscatedNames() bool {
+	return viper.GetBool("obfuscate_names")
+}
+
+// loadIndex reads and verifies the index of the vault. A vault without index starts with an empty one.
+func loadIndex() (*tresor.NameIndex, error) {
+	if cachedIndex != nil {
+		return cachedIndex, nil
+	}
+	bucket := viper.Get("bucket").(string)
+
+	attrs, err := tresor.ReadMetadata(bucket, tresor.IndexObject, 0)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		if cachedIndex, err = tresor.NewNameIndex(); err != nil {
+			return nil, err
+		}
+		return cachedIndex, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedBytes, err := tresor.ReadObject(bucket, tresor.IndexObject, attrs.Generation)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index decides which objects are read, so it has to be signed by a pinned key
+	ring, err := cachedRing()
+	if err != nil {
+		return nil, err
+	}
+	policy := signaturePolicy(attrs.Metadata["Signing-Key"])
+	policy.RequireSignature = true
+	decryptor := &tresor.OpenPGPCrypto{Ring: ring, Policy: policy}
+
+	plainBytes, signature, err := decryptor.Decrypt(encryptedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if err = checkSignerPin(signature); err != nil {
+		return nil, err
+	}
+	if _, err = checkMetadata(tresor.IndexObject, attrs, signature); err != nil {
+		return nil, err
+	}
+
+	if cachedIndex, err = tresor.ParseNameIndex(plainBytes); err != nil {
+		return nil, err
+	}
+	cachedIndexGeneration = attrs.Generation
+	return cachedIndex, nil
+}
+
+// saveIndex encrypts, signs and writes the index. It fails if the index was changed since it was read.
+func saveIndex(index *tresor.NameIndex) error {
+	bucket := viper.Get("bucket").(string)
+	armored := viper.Get("ascii_armor").(bool)
+
+	plainBytes, err := index.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %v", err)
+	}
+
+	recipients, err := loadRecipients(viper.GetStringSlice("index_recipients"))
+	if err != nil {
+		return err
+	}
+	signer, err := loadSigner()
+	if err != nil {
+		return err
+	}
+
+	settings := cryptoSettings()
+	encryptor := &tresor.OpenPGPCrypto{Recipients: recipients, Signer: signer, Armored: armored, Settings: settings}
+	encryptedBytes, err := encryptor.Encrypt(plainBytes)
+	if err != nil {
+		return err
+	}
+
+	generation, err := tresor.WriteObjectIfGeneration(bucket, tresor.IndexObject, encryptedBytes, cachedIndexGeneration)
+	if err != nil {
+		return fmt.Errorf("failed to write index, it may have been changed concurrently: %v", err)
+	}
+	cachedIndexGeneration = generation
+
+	meta := tresor.CreateMetadata(recipients, signer, armored, settings)
+	if err = tresor.SignMetadata(signer, tresor.IndexObject, generation, &meta, settings); err != nil {
+		return err
+	}
+	return tresor.WriteMetadata(bucket, tresor.IndexObject, meta)
+}
+
+// storageName returns the name an existing object is stored under
+func storageName(name string) (string, error) {
+	if !obfuscatedNames() {
+		return name, nil
+	}
+	index, err := loadIndex()
+	if err != nil {
+		return "", err
+	}
+	stored, ok := index.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("object not found in index: %s", name)
+	}
+	return stored, nil
+}
+
+// displayName returns the real name of an object stored under a name
+func displayName(stored string) string {
+	if !obfuscatedNames() || cachedIndex == nil {
+		return stored
+	}
+	if name, ok := cachedIndex.Name(stored); ok {
+		return name
+	}
+	return stored
+}
+
+// listNames lists the names of all objects with a prefix. With obfuscated names, index entries
+// of objects that were never stored or failed to be removed are left out.
+func listNames(prefix string) ([]string, error) {
+	if obfuscatedNames() {
+		index, err := loadIndex()
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := tresor.QueryStorage(viper.Get("bucket").(string), "", false)
+		if err != nil {
+			return nil, err
+		}
+		stored := map[string]bool{}
+		for _, attr := range attrs {
+			stored[attr.Name] = true
+		}
+		var names []string
+		for _, name := range index.Names(prefix) {
+			if storageName, _ := index.Lookup(name); stored[storageName] {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+
+	attrs, err := tresor.QueryStorage(viper.Get("bucket").(string), prefix, false)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, attr := range attrs {
+		if tresor.StateObjectName(attr.Name) {
+			names = append(names, attr.Name)
+		}
+	}
+	return names, nil
+}
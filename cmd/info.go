@@ -3,12 +3,15 @@ package cmd
 import (
 	"encoding/hex"
 	"fmt"
+	"os"
 
 	tresor "github.com/helloworlddan/tresor/lib"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+var verifySignature bool
+
 var infoCmd = &cobra.Command{
 	Use:   "info",
 	Short: "Get info on remote objects.",
@@ -18,21 +21,87 @@ var infoCmd = &cobra.Command{
 		if len(args) != 1 {
 			fail(fmt.Errorf("no object key specified"))
 		}
-		key := args[0]
+		key, err := storageName(args[0])
+		if err != nil {
+			fail(err)
+		}
 
-		attrs, err := tresor.ReadMetadata(viper.Get("bucket").(string), key)
+		attrs, err := tresor.ReadMetadata(viper.Get("bucket").(string), key, 0)
 		if err != nil {
 			fail(err)
 		}
 
-		fmt.Printf("Name\t\t%v\n", attrs.Name)
+		var signature *tresor.Signature
+		var header *tresor.ObjectHeader
+		if verifySignature {
+			decryptor, err := decryptionCrypto(attrs.Metadata)
+			if err != nil {
+				fail(err)
+			}
+			encryptedBytes, err := tresor.ReadObject(viper.Get("bucket").(string), key, attrs.Generation)
+			if err != nil {
+				fail(err)
+			}
+			var plainBytes []byte
+			plainBytes, signature, err = decryptor.Decrypt(encryptedBytes)
+			if err != nil {
+				fail(err)
+			}
+			if err = checkSignerPin(signature); err != nil {
+				fail(err)
+			}
+			if header, _, err = tresor.UnwrapHeader(plainBytes); err != nil {
+				fail(err)
+			}
+			if err = checkObjectName(args[0], header); err != nil {
+				fail(err)
+			}
+			if err = checkGeneration(args[0], attrs, header); err != nil {
+				fail(err)
+			}
+		}
+
+		fmt.Printf("Name\t\t%v\n", displayName(attrs.Name))
 		fmt.Printf("Size\t\t%v bytes\n", attrs.Size)
 		fmt.Printf("MD5\t\t%v\n", hex.EncodeToString(attrs.MD5))
 		fmt.Printf("Type\t\t%v\n", attrs.ContentType)
 		fmt.Printf("Modified\t%v\n", attrs.Updated)
 
 		for k, v := range attrs.Metadata {
-			fmt.Printf("%v\t%v\n", k, v)
+			if k != tresor.MetadataSignature {
+				fmt.Printf("%v\t%v\n", k, v)
+			}
+		}
+
+		// Flag changed metadata
+		metadataSignature, metadataErr := checkMetadata(args[0], attrs, signature)
+		if metadataErr != nil {
+			fmt.Printf("Metadata\tINVALID, %v\n", metadataErr)
+		} else if metadataSignature.Signed {
+			fmt.Printf("Metadata\tverified, %s\n", metadataSignature.Identity())
+		} else {
+			fmt.Printf("Metadata\tunsigned\n")
+		}
+
+		if header != nil {
+			if header.Filename != "" {
+				fmt.Printf("Filename\t%v\n", header.Filename)
+			}
+			fmt.Printf("Content-Type\t%v\n", header.ContentType)
+			if header.Mode != 0 {
+				fmt.Printf("Mode\t\t%v\n", header.Mode)
+			}
+			if !header.ModTime.IsZero() {
+				fmt.Printf("File-Modified\t%v\n", header.ModTime)
+			}
+			fmt.Printf("Plain-Size\t%v bytes\n", header.Size)
+			fmt.Printf("SHA-256\t\t%v\n", header.SHA256)
+		}
+
+		if signature != nil && signature.Signed {
+			fmt.Printf("Signature\tverified, %s\n", signature.Identity())
+		} else if signature != nil {
+			fmt.Printf("Signature\tnone\n")
 		}
 
 		versions, err := tresor.QueryStorage(viper.Get("bucket").(string), key, true)
@@ -50,9 +119,14 @@ var infoCmd = &cobra.Command{
 				fmt.Printf("Version\t\t%v\n- Modified\t%v\n", v.Generation, v.Updated.String())
 			}
 		}
+
+		if metadataErr != nil {
+			os.Exit(exitVerificationFailed)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(infoCmd)
+	infoCmd.Flags().BoolVarP(&verifySignature, "verify", "V", false, "Decrypt the object to verify its signature and show the original file.")
 }
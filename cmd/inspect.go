@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	decryptInspected bool
+	inspectVersion   int64
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Show the packets of a remote object or local file.",
+	Long: `Show the packets of a remote object or local file.
+
+The OpenPGP packets are listed without verifying them, to debug objects that
+fail to decrypt: armor, the key IDs the object is encrypted to, the cipher and
+integrity protection of the encrypted data. No private key is needed for this.
+Compression, signatures and literal data are inside the encrypted data and only
+listed with --decrypt, which uses the private key or asks for the passphrase.
+For age files, the recipient stanzas are listed.
+
+If the argument is an existing local file, the file is inspected, otherwise
+the remote object with that key.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Check for correct number of arguments
+		if len(args) != 1 {
+			fail(fmt.Errorf("no object key or file specified"))
+		}
+
+		reader, err := openInspected(args[0])
+		if err != nil {
+			fail(err)
+		}
+		defer reader.Close()
+
+		// Keys only name recipients and signers, unless the object is decrypted
+		ring, err := cachedRing()
+		if err != nil && decryptInspected {
+			fail(err)
+		}
+		inspection, err := tresor.InspectMessage(reader, ring, decryptInspected)
+		if inspection != nil {
+			printInspection(inspection)
+		}
+		if err != nil {
+			fail(err)
+		}
+	},
+}
+
+// openInspected opens a local file, or the remote object if there is no such file
+func openInspected(name string) (io.ReadCloser, error) {
+	if info, err := os.Stat(name); err == nil && !info.IsDir() {
+		fmt.Printf("File\t\t%s\n", name)
+		return os.Open(name)
+	}
+
+	key, err := storageName(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := tresor.OpenObject(viper.Get("bucket").(string), key, inspectVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	fmt.Printf("Object\t\t%s\n", name)
+	return reader, nil
+}
+
+func printInspection(inspection *tresor.Inspection) {
+	armored := "no"
+	if inspection.Payload.Armored {
+		armored = "yes"
+	}
+	fmt.Printf("Format\t\t%s\n", inspection.Payload.Format)
+	fmt.Printf("Armor\t\t%s\n", armored)
+
+	for _, packet := range inspection.Packets {
+		indent := strings.Repeat("\t", packet.Depth)
+		fmt.Printf("%sPacket\t\t%s\n", indent, packet.Type)
+		for _, field := range packet.Fields {
+			separator := "\t"
+			if len(field.Name) < 8 {
+				separator = "\t\t"
+			}
+			fmt.Printf("%s\t%s%s%s\n", indent, field.Name, separator, field.Value)
+		}
+	}
+
+	if inspection.Encrypted {
+		if inspection.Payload.Format == tresor.FormatOpenPGP && !decryptInspected {
+			fmt.Printf("Contents\tencrypted, use --decrypt to list the packets inside\n")
+		} else {
+			fmt.Printf("Contents\tencrypted\n")
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+	inspectCmd.Flags().BoolVarP(&decryptInspected, "decrypt", "d", false, "Decrypt the object to list the packets inside the encrypted data.")
+	inspectCmd.Flags().Int64VarP(&inspectVersion, "version", "v", 0, "Version of the object to inspect.")
+}
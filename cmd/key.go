@@ -0,0 +1,451 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	tresor "github.com/helloworlddan/tresor/lib"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	keyName      string
+	keyEmail     string
+	keyComment   string
+	keyAlgorithm string
+	keyExpires   string
+	keyV6        bool
+	keyForce     bool
+	exportSecret bool
+	newPassFile  string
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the configured key pair.",
+	Long: `Manage the configured key pair.
+
+All subcommands operate on the files referenced by 'public_key' and 'private_key'.`,
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new key pair.",
+	Long: `Generate a new key pair and write it to 'public_key' and 'private_key'.
+
+The private key is protected with a new passphrase, which is prompted for on the
+terminal, or read from the file given with --new-passphrase-file. It is never
+taken from the configured source. Keys are stored unprotected if
+'passphrase_source' is none. Keys advertise the algorithms of the 'crypto' section.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if keyName == "" && keyEmail == "" {
+			fail(fmt.Errorf("no name or email specified"))
+		}
+
+		publicLocation, privateLocation, err := keyLocations()
+		if err != nil {
+			fail(err)
+		}
+		if !keyForce {
+			for _, location := range []string{publicLocation, privateLocation} {
+				if _, err := os.Stat(location); err == nil {
+					fail(fmt.Errorf("refusing to overwrite existing key %s. Use --force to replace it", location))
+				}
+			}
+		}
+
+		lifetime, err := parseLifetime(keyExpires)
+		if err != nil {
+			fail(err)
+		}
+
+		settings := cryptoSettings()
+		spec := &tresor.KeySpec{
+			Name:      keyName,
+			Comment:   keyComment,
+			Email:     keyEmail,
+			Algorithm: keyAlgorithm,
+			V6:        keyV6,
+			Lifetime:  lifetime,
+		}
+		entity, err := tresor.GenerateKey(spec, settings)
+		if err != nil {
+			fail(err)
+		}
+
+		if viper.GetString("passphrase_source") == "none" {
+			fmt.Fprintln(os.Stderr, "Warning: 'passphrase_source' is none, the private key is stored unencrypted.")
+		} else {
+			passphrase, err := newPassphrase(entity.PrimaryKey.KeyIdString(), newPassFile)
+			if err != nil {
+				fail(err)
+			}
+			if len(passphrase) == 0 {
+				fail(fmt.Errorf("refusing to protect private key with an empty passphrase"))
+			}
+			if err = tresor.ProtectPrivateKeys(entity, passphrase, settings); err != nil {
+				fail(err)
+			}
+		}
+
+		if err = tresor.WriteArmoredKey(privateLocation, entity, true); err != nil {
+			fail(err)
+		}
+		if err = tresor.WriteArmoredKey(publicLocation, entity, false); err != nil {
+			fail(err)
+		}
+
+		// The new key replaces any previous one of the same identities
+		if vault := viper.GetString("bucket"); vault != "" {
+			pins, err := loadKeyPins()
+			if err != nil {
+				fail(err)
+			}
+			for _, identity := range tresor.KeyIdentities(entity) {
+				pins.Trust(vault, identity, tresor.Fingerprint(entity))
+			}
+			if err = pins.Save(); err != nil {
+				fail(err)
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "Generated key %s\n", tresor.Fingerprint(entity))
+	},
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all configured keys.",
+	Long:  `List all configured keys, including private keys and the public keys of other signers.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		locations := viper.GetStringSlice("private_keys")
+		for _, key := range []string{"private_key", "public_key"} {
+			if location := viper.GetString(key); location != "" {
+				locations = append([]string{location}, locations...)
+			}
+		}
+		locations = append(locations, viper.GetStringSlice("signer_keys")...)
+
+		var ring openpgp.EntityList
+		for _, location := range locations {
+			keys, err := tresor.LoadArmoredKeyRing(location)
+			if err != nil {
+				fail(err)
+			}
+			ring = append(ring, keys...)
+		}
+		if directory := viper.GetString("private_keyring"); directory != "" {
+			keys, err := tresor.LoadKeyRingDirectory(directory)
+			if err != nil {
+				fail(err)
+			}
+			ring = append(ring, keys...)
+		}
+
+		// The same key is usually configured as public and private key
+		listed := map[string]int{}
+		var entities openpgp.EntityList
+		for _, entity := range ring {
+			fingerprint := tresor.Fingerprint(entity)
+			if index, ok := listed[fingerprint]; ok {
+				if entity.PrivateKey != nil {
+					entities[index] = entity
+				}
+				continue
+			}
+			listed[fingerprint] = len(entities)
+			entities = append(entities, entity)
+		}
+
+		for _, entity := range entities {
+			kind := "pub"
+			if entity.PrivateKey != nil {
+				kind = "sec"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", kind, tresor.Fingerprint(entity), formatExpiry(tresor.KeyExpiry(entity)), tresor.PrimaryIdentity(entity))
+		}
+	},
+}
+
+var keyShowCmd = &cobra.Command{
+	Use:   "show [file]",
+	Short: "Show details of a key.",
+	Long:  `Show details of a key. Shows the private key, or the public key if no private key is configured, unless a file is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		location := viper.GetString("private_key")
+		if location == "" {
+			location = viper.GetString("public_key")
+		}
+		if len(args) == 1 {
+			location = args[0]
+		}
+		if location == "" {
+			fail(fmt.Errorf("no key specified"))
+		}
+
+		entity, err := tresor.LoadArmoredKey(location)
+		if err != nil {
+			fail(err)
+		}
+
+		fmt.Printf("Fingerprint\t%s\n", tresor.Fingerprint(entity))
+		fmt.Printf("Algorithm\t%s\n", tresor.KeyAlgorithm(entity.PrimaryKey))
+		fmt.Printf("Version\t\t%d\n", entity.PrimaryKey.Version)
+		fmt.Printf("Created\t\t%v\n", entity.PrimaryKey.CreationTime)
+		fmt.Printf("Expires\t\t%s\n", formatExpiry(tresor.KeyExpiry(entity)))
+		fmt.Printf("Status\t\t%s\n", tresor.CheckKey(entity, time.Now()))
+		if entity.PrivateKey != nil {
+			fmt.Printf("Secret\t\t%s\n", secretState(entity.PrivateKey.Encrypted))
+		}
+		for _, identity := range entity.Identities {
+			fmt.Printf("UID\t\t%s\n", identity.Name)
+		}
+		for _, subkey := range entity.Subkeys {
+			fmt.Printf("Subkey\t\t%s\t%s\t%s\texpires %s\n", subkey.PublicKey.KeyIdString(), tresor.KeyAlgorithm(subkey.PublicKey), tresor.KeyUsage(subkey.Sig), formatExpiry(tresor.SubkeyExpiry(&subkey)))
+		}
+	},
+}
+
+var keyExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the public key.",
+	Long:  `Export the armored public key to STDOUT, or the private key with --secret.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		location := viper.GetString("public_key")
+		if exportSecret {
+			location = viper.GetString("private_key")
+		}
+		if location == "" {
+			fail(fmt.Errorf("no key configured. Set 'public_key' and 'private_key'"))
+		}
+
+		entity, err := tresor.LoadArmoredKey(location)
+		if err != nil {
+			fail(err)
+		}
+
+		blockType := openpgp.PublicKeyType
+		if exportSecret {
+			if entity.PrivateKey == nil {
+				fail(fmt.Errorf("%s contains no private key", location))
+			}
+			blockType = openpgp.PrivateKeyType
+		}
+
+		output, err := armor.Encode(os.Stdout, blockType, nil)
+		if err != nil {
+			fail(err)
+		}
+		if exportSecret {
+			err = entity.SerializePrivateWithoutSigning(output, nil)
+		} else {
+			err = entity.Serialize(output)
+		}
+		if err != nil {
+			fail(err)
+		}
+		if err = output.Close(); err != nil {
+			fail(err)
+		}
+		fmt.Println()
+	},
+}
+
+var keyPasswdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change the passphrase of the private key.",
+	Long: `Change the passphrase of the private key in 'private_key'.
+
+The current passphrase is read from the configured source. The new one is
+prompted for on the terminal, or read from the file given with
+--new-passphrase-file. Afterwards, update the configured source.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, location, err := keyLocations()
+		if err != nil {
+			fail(err)
+		}
+
+		entity, err := tresor.LoadArmoredKey(location)
+		if err != nil {
+			fail(err)
+		}
+		if err = tresor.UnlockEntity(entity); err != nil {
+			fail(err)
+		}
+
+		passphrase, err := newPassphrase(entity.PrimaryKey.KeyIdString(), newPassFile)
+		if err != nil {
+			fail(err)
+		}
+		if len(passphrase) == 0 {
+			fail(fmt.Errorf("refusing to protect private key with an empty passphrase"))
+		}
+		if err = tresor.ProtectPrivateKeys(entity, passphrase, cryptoSettings()); err != nil {
+			fail(err)
+		}
+
+		if err = tresor.WriteArmoredKey(location, entity, true); err != nil {
+			fail(err)
+		}
+
+		// Keys unlocked with the old passphrase are dropped from the agent
+		tresor.ForgetAgentKey(entity.PrimaryKey.KeyIdString())
+		for _, subkey := range entity.Subkeys {
+			tresor.ForgetAgentKey(subkey.PublicKey.KeyIdString())
+		}
+		fmt.Fprintf(os.Stderr, "Changed passphrase of key %s\n", tresor.Fingerprint(entity))
+	},
+}
+
+var keyPublishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "Publish the public key to the vault.",
+	Long: `Publish the public key in 'public_key' to the key directory of the vault, so
+other members can encrypt objects to it with 'tresor put --to'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		entity, err := tresor.LoadArmoredKey(viper.Get("public_key").(string))
+		if err != nil {
+			fail(err)
+		}
+		key, err := tresor.PublishKey(viper.Get("bucket").(string), entity)
+		if err != nil {
+			fail(err)
+		}
+		if err = appendAudit("publish", key, "", 0); err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "Published key %s to %s\n", tresor.Fingerprint(entity), key)
+	},
+}
+
+// resolveRecipients looks up published keys by email or fingerprint. If several keys are
+// published for an email, the pinned one is used.
+func resolveRecipients(bucket string, queries []string) (openpgp.EntityList, error) {
+	pins, err := loadKeyPins()
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients openpgp.EntityList
+	for _, query := range queries {
+		found, err := tresor.FindKeys(bucket, query)
+		if err != nil {
+			return nil, err
+		}
+
+		key := found[0]
+		if len(found) > 1 {
+			pinned, _ := pins.Lookup(bucket, query)
+			var fingerprints []string
+			key = nil
+			for _, candidate := range found {
+				fingerprints = append(fingerprints, tresor.Fingerprint(candidate.Entity))
+				if pinned == tresor.Fingerprint(candidate.Entity) {
+					key = candidate
+				}
+			}
+			if key == nil {
+				return nil, fmt.Errorf("several keys published for %s: %s. Select one by fingerprint", query, strings.Join(fingerprints, ", "))
+			}
+		}
+		recipients = append(recipients, key.Entity)
+	}
+	return recipients, nil
+}
+
+// keyLocations returns the configured locations of the public and private key
+func keyLocations() (string, string, error) {
+	publicLocation, err := homedir.Expand(viper.GetString("public_key"))
+	if err != nil {
+		return "", "", err
+	}
+	privateLocation, err := homedir.Expand(viper.GetString("private_key"))
+	if err != nil {
+		return "", "", err
+	}
+	if publicLocation == "" || privateLocation == "" {
+		return "", "", fmt.Errorf("no key files configured. Set 'public_key' and 'private_key'")
+	}
+	return publicLocation, privateLocation, nil
+}
+
+// parseLifetime parses a key lifetime like 90d, 2w or 1y, or a duration. Keys never expire with "never" or 0.
+// Lifetimes are recorded in whole seconds, up to about 136 years.
+func parseLifetime(value string) (time.Duration, error) {
+	if value == "" || value == "never" || value == "0" {
+		return 0, nil
+	}
+
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if count, err := strconv.Atoi(strings.TrimSuffix(value, suffix)); err == nil && strings.HasSuffix(value, suffix) {
+			if count < 0 {
+				break
+			}
+			if count > int(tresor.MaxKeyLifetime/unit) {
+				return 0, fmt.Errorf("key expiry %s is too far away, keys can expire after at most %d days", value, tresor.MaxKeyLifetime/(24*time.Hour))
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime < 0 {
+		return 0, fmt.Errorf("invalid key expiry: %s", value)
+	}
+	if lifetime > tresor.MaxKeyLifetime {
+		return 0, fmt.Errorf("key expiry %s is too far away, keys can expire after at most %d days", value, tresor.MaxKeyLifetime/(24*time.Hour))
+	}
+	if lifetime > 0 && lifetime < time.Second {
+		return 0, fmt.Errorf("key expiry %s is shorter than a second, use never for keys that do not expire", value)
+	}
+	return lifetime, nil
+}
+
+func formatExpiry(expiry time.Time) string {
+	if expiry.IsZero() {
+		return "never"
+	}
+	if expiry.Before(time.Now()) {
+		return fmt.Sprintf("%s (expired)", expiry.Format("2006-01-02"))
+	}
+	return expiry.Format("2006-01-02")
+}
+
+func secretState(encrypted bool) string {
+	if encrypted {
+		return "present, protected by passphrase"
+	}
+	return "present, unprotected"
+}
+
+func init() {
+	rootCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(keyGenerateCmd)
+	keyCmd.AddCommand(keyListCmd)
+	keyCmd.AddCommand(keyShowCmd)
+	keyCmd.AddCommand(keyExportCmd)
+	keyCmd.AddCommand(keyPasswdCmd)
+	keyCmd.AddCommand(keyPublishCmd)
+	keyPasswdCmd.Flags().StringVar(&newPassFile, "new-passphrase-file", "", "File to read the new passphrase from, instead of prompting for it.")
+	keyGenerateCmd.Flags().StringVarP(&keyName, "name", "n", "", "Name of the key owner.")
+	keyGenerateCmd.Flags().StringVarP(&keyEmail, "email", "e", "", "Email of the key owner.")
+	keyGenerateCmd.Flags().StringVar(&keyComment, "comment", "", "Comment of the user ID.")
+	keyGenerateCmd.Flags().StringVarP(&keyAlgorithm, "algorithm", "a", "ed25519", "Key algorithm: ed25519, rsa3072 or rsa4096.")
+	keyGenerateCmd.Flags().StringVarP(&keyExpires, "expires", "x", "2y", "Time until the key expires, like 90d, 2w or 1y, or never.")
+	keyGenerateCmd.Flags().BoolVar(&keyV6, "v6", false, "Generate an RFC 9580 version 6 key.")
+	keyGenerateCmd.Flags().StringVar(&newPassFile, "new-passphrase-file", "", "File to read the passphrase of the new key from, instead of prompting for it.")
+	keyGenerateCmd.Flags().BoolVarP(&keyForce, "force", "f", false, "Replace existing key files.")
+	keyExportCmd.Flags().BoolVarP(&exportSecret, "secret", "s", false, "Export the private key instead.")
+}
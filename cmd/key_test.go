@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLifetime(t *testing.T) {
+	day := 24 * time.Hour
+
+	tests := []struct {
+		value    string
+		lifetime time.Duration
+		ok       bool
+	}{
+		{"", 0, true},
+		{"never", 0, true},
+		{"0", 0, true},
+		{"90d", 90 * day, true},
+		{"2w", 14 * day, true},
+		{"1y", 365 * day, true},
+		{"0d", 0, true},
+		{"36h", 36 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"-1d", 0, false},
+		{"-1h", 0, false},
+		{"d", 0, false},
+		{"1.5d", 0, false},
+		{"1m2d", 0, false},
+		{"forever", 0, false},
+		{"90", 0, false},
+		{"49710d", 49710 * day, true},
+		{"49711d", 0, false},
+		{"7101w", 7101 * 7 * day, true},
+		{"7102w", 0, false},
+		{"136y", 136 * 365 * day, true},
+		{"137y", 0, false},
+		{"300y", 0, false},
+		{"1193046h", 1193046 * time.Hour, true},
+		{"1193047h", 0, false},
+		{"9999999999999999999d", 0, false},
+		{"1s", time.Second, true},
+		{"500ms", 0, false},
+	}
+	for _, test := range tests {
+		lifetime, err := parseLifetime(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("parseLifetime(%q) error = %v, want ok %v", test.value, err, test.ok)
+			continue
+		}
+		if lifetime != test.lifetime {
+			t.Errorf("parseLifetime(%q) = %v, want %v", test.value, lifetime, test.lifetime)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var verifyLog bool
+
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Show the audit log of the vault.",
+	Long: `Show the audit log of the vault, optionally only the entries for one key.
+
+If 'audit_log' is enabled, every put, cp, rm, key publish, metadata repair and
+new vault state by fsck appends an entry signed with the private key to the
+audit log. Each entry refers to the hash of the entry before it. With --verify,
+the chain and all signatures are checked and the command exits with status 3 if
+the log was tampered with.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Check for correct number of arguments
+		if len(args) > 1 {
+			fail(fmt.Errorf("specify at most one key"))
+		}
+
+		records, err := tresor.ReadAuditLog(viper.Get("bucket").(string))
+		if err != nil {
+			fail(err)
+		}
+
+		// Entries record storage names, which are resolved with the index
+		var key string
+		if len(args) == 1 {
+			key = args[0]
+		}
+		if obfuscatedNames() {
+			index, err := loadIndex()
+			if err != nil {
+				fail(err)
+			}
+			if key != "" {
+				key = index.StorageName(key)
+			}
+		}
+
+		failed := 0
+		var previous *tresor.AuditRecord
+		for _, record := range records {
+			var signature *tresor.Signature
+			if verifyLog {
+				signature, err = verifyAuditRecord(record, previous)
+				if err != nil {
+					failed++
+				}
+			}
+			previous = record
+
+			entry := record.Entry
+			if key != "" && entry.Key != key && entry.Source != key && err == nil {
+				continue
+			}
+			printAuditEntry(entry, signature, err)
+		}
+
+		if verifyLog {
+			fmt.Fprintf(os.Stderr, "%d entries verified, %d failed\n", len(records)-failed, failed)
+			if failed > 0 {
+				os.Exit(exitVerificationFailed)
+			}
+		}
+	},
+}
+
+// verifyAuditRecord checks an entry of the audit log against the one before it and the signature policy
+func verifyAuditRecord(record *tresor.AuditRecord, previous *tresor.AuditRecord) (*tresor.Signature, error) {
+	ring, err := cachedRing()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := record.Verify(ring, previous)
+	if err != nil {
+		return nil, err
+	}
+	if signature.Signer == nil {
+		return signature, fmt.Errorf("entry %d is signed by unknown key %016X, add it to 'signer_keys'", record.Entry.Sequence, signature.KeyID)
+	}
+	if err = signaturePolicy("").Verify(signature); err != nil {
+		return signature, fmt.Errorf("entry %d: %v", record.Entry.Sequence, err)
+	}
+	return signature, checkSignerPin(signature)
+}
+
+func printAuditEntry(entry *tresor.AuditEntry, signature *tresor.Signature, err error) {
+	name := displayName(entry.Key)
+	if entry.Source != "" {
+		name = displayName(entry.Source) + " -> " + name
+	}
+	signer := entry.Signer
+	if signature != nil && signature.Signer != nil {
+		signer = signature.Identity()
+	}
+
+	status := ""
+	if verifyLog && err != nil {
+		status = "FAILED\t"
+	} else if verifyLog {
+		status = "OK\t"
+	}
+	fmt.Printf("%s%d\t%s\t%s\t%s\t%s\n", status, entry.Sequence, entry.Time.Local().Format(time.RFC3339), entry.Action, name, signer)
+	if err != nil {
+		fmt.Printf("\tError\t%v\n", err)
+	}
+}
+
+// auditing reports whether changes to the vault are recorded in its audit log
+func auditing() bool {
+	return viper.GetBool("audit_log")
+}
+
+// appendAudit records a change to the vault in its audit log, if enabled. Keys are recorded as
+// they are stored, so obfuscated names stay hidden.
+func appendAudit(action string, key string, source string, generation int64) error {
+	if !auditing() {
+		return nil
+	}
+	signer, err := loadSigner()
+	if err != nil {
+		return err
+	}
+	entry := &tresor.AuditEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Key:        key,
+		Source:     source,
+		Generation: generation,
+	}
+	return tresor.AppendAuditEntry(viper.Get("bucket").(string), signer, entry, cryptoSettings())
+}
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+	logCmd.Flags().BoolVar(&verifyLog, "verify", false, "Check the chain and signatures of all entries.")
+}
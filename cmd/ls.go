@@ -3,9 +3,7 @@ package cmd
 import (
 	"fmt"
 
-	tresor "github.com/helloworlddan/tresor/lib"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var lsCmd = &cobra.Command{
@@ -19,13 +17,13 @@ var lsCmd = &cobra.Command{
 			prefixFilter = args[0]
 		}
 
-		attrs, err := tresor.QueryStorage(viper.Get("bucket").(string), prefixFilter, false)
+		names, err := listNames(prefixFilter)
 		if err != nil {
 			fail(err)
 		}
 
-		for _, v := range attrs {
-			fmt.Printf("%s\n", v.Name)
+		for _, name := range names {
+			fmt.Printf("%s\n", name)
 		}
 	},
 }
@@ -4,21 +4,33 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
-	"syscall"
+	"strings"
 
+	"cloud.google.com/go/storage"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	tresor "github.com/helloworlddan/tresor/lib"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
 	localReadPath     string
 	interactivePrompt bool
+	cipherAlgorithm   string
+	hashAlgorithm     string
+	compressionAlgo   string
+	compressionLevel  int
+	aeadEncryption    bool
+	s2kMode           string
+	s2kCount          int
+	symmetricObject   bool
+	symmetricPassFile string
+	extraRecipients   []string
 )
 
+var cachedSigner *openpgp.Entity
+
 var putCmd = &cobra.Command{
 	Use:   "put",
 	Short: "Encrypt a local object and put it to remote storage.",
@@ -29,59 +41,308 @@ var putCmd = &cobra.Command{
 		}
 		key := args[0]
 
-		// Read input
-		plainBytes, err := readInput(localReadPath, interactivePrompt, viper.Get("object_signing").(bool))
+		// Select format for key
+		format, err := objectFormat(key)
 		if err != nil {
 			fail(err)
 		}
+		if symmetricObject && format != tresor.FormatOpenPGP {
+			fail(fmt.Errorf("symmetric objects are only supported in the openpgp format"))
+		}
+		if symmetricPassFile != "" && !symmetricObject {
+			fail(fmt.Errorf("--passphrase-file requires --symmetric"))
+		}
+		if len(extraRecipients) > 0 && (symmetricObject || format != tresor.FormatOpenPGP) {
+			fail(fmt.Errorf("additional recipients are only supported for openpgp objects encrypted to keys"))
+		}
+		signing := format == tresor.FormatOpenPGP && viper.Get("object_signing").(bool) && !symmetricObject
 
-		// Load keys
-		recipient, err := tresor.LoadArmoredKey(viper.Get("public_key").(string))
+		// Read input
+		plainBytes, err := readInput(localReadPath, interactivePrompt, symmetricPrompt() || ((signing || obfuscatedNames() || auditing() || trackingState()) && interactivePassphrase()))
 		if err != nil {
 			fail(err)
 		}
 
-		var signer *openpgp.Entity
-
-		// Sign object if configured
-		if viper.Get("object_signing").(bool) {
-			// Load private keys for signature
-			signer, err = tresor.LoadArmoredKey(viper.Get("private_key").(string))
-			if err != nil {
+		// Store under an obfuscated name if configured
+		storedKey := key
+		var index *tresor.NameIndex
+		if obfuscatedNames() {
+			if index, err = loadIndex(); err != nil {
 				fail(err)
 			}
+			storedKey = index.StorageName(key)
 
-			// Get password
-			password, err := tresor.GetUserPassword(signer.PrivateKey.KeyIdString())
-			if err != nil {
-				fail(err)
+			// Record new objects before storing them, so no object is left without index entry
+			if _, known := index.Lookup(key); !known {
+				index.Add(key)
+				if err = saveIndex(index); err != nil {
+					fail(err)
+				}
 			}
-			// Decrypt private key
-			signer.PrivateKey.Decrypt(password)
 		}
 
-		// Encrypt and sign
-		encryptedBytes, err := tresor.EncryptBytes(recipient, signer, plainBytes, viper.Get("ascii_armor").(bool))
+		// Find the generation this object replaces
+		generation, err := tresor.ObjectGeneration(viper.Get("bucket").(string), storedKey)
 		if err != nil {
 			fail(err)
 		}
 
+		// Encrypt and sign. Passphrase-only objects stay plain messages without header,
+		// so they can be decrypted without tresor.
+		var encryptedBytes []byte
+		var meta storage.ObjectAttrsToUpdate
+		if symmetricObject {
+			var encryptor tresor.Crypto
+			if encryptor, meta, err = symmetricCrypto(); err != nil {
+				fail(err)
+			}
+			if encryptedBytes, err = encryptor.Encrypt(plainBytes); err != nil {
+				fail(err)
+			}
+		} else {
+			header, err := tresor.NewObjectHeader(localReadPath, plainBytes)
+			if err != nil {
+				fail(err)
+			}
+			header.Name = key
+			header.Replaces = generation
+			var encryptor tresor.Crypto
+			if encryptor, meta, err = encryptionCrypto(format); err != nil {
+				fail(err)
+			}
+			if encryptedBytes, err = sealObject(encryptor, header, plainBytes); err != nil {
+				fail(err)
+			}
+		}
+
 		// Write to storage
-		if err = tresor.WriteObject(viper.Get("bucket").(string), key, encryptedBytes); err != nil {
+		var signer *openpgp.Entity
+		if signing {
+			signer = cachedSigner
+		}
+		newGeneration, err := storeObject(key, storedKey, encryptedBytes, meta, generation, signer)
+		if err != nil {
 			fail(err)
 		}
-
-		// Create metadata
-		meta := tresor.CreateMetadata(recipient, signer, filepath.Ext(localReadPath), viper.Get("ascii_armor").(bool))
-
-		// Write metadata
-		if err = tresor.WriteMetadata(viper.Get("bucket").(string), key, meta); err != nil {
+		stateErr := recordState(key, storedKey, newGeneration)
+		if err = appendAudit("put", storedKey, "", newGeneration); err != nil {
 			fail(err)
 		}
+		if stateErr != nil {
+			fail(stateErr)
+		}
 	},
 }
 
-func readInput(localPath string, interactive bool, objectSigning bool) ([]byte, error) {
+// sealObject puts the header in front of the content of an object, pads and encrypts it
+func sealObject(encryptor tresor.Crypto, header *tresor.ObjectHeader, content []byte) ([]byte, error) {
+	plainBytes, err := tresor.WrapHeader(header, content)
+	if err != nil {
+		return nil, err
+	}
+	if plainBytes, err = objectPadding(encryptor.Format()).Pad(plainBytes); err != nil {
+		return nil, err
+	}
+	return encryptor.Encrypt(plainBytes)
+}
+
+// storeObject writes an encrypted object and its metadata, unless the object was changed since the
+// generation it replaces. Metadata of signed objects is signed by the same key. The new generation
+// is recorded as seen and returned.
+func storeObject(name string, storedKey string, encryptedBytes []byte, meta storage.ObjectAttrsToUpdate, generation int64, signer *openpgp.Entity) (int64, error) {
+	bucket := viper.Get("bucket").(string)
+
+	newGeneration, err := tresor.WriteObjectIfGeneration(bucket, storedKey, encryptedBytes, generation)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write object, it may have been changed concurrently: %v", err)
+	}
+	if signer != nil {
+		if err = tresor.SignMetadata(signer, name, newGeneration, &meta, cryptoSettings()); err != nil {
+			return 0, err
+		}
+	}
+	if err = tresor.WriteMetadata(bucket, storedKey, meta); err != nil {
+		return 0, err
+	}
+
+	return newGeneration, recordGeneration(name, newGeneration)
+}
+
+// recordState records a new generation of a stored object in the vault state. The object is
+// changed already, so failures explain how to record it later.
+func recordState(name string, storedKey string, generation int64) error {
+	if !trackingState() {
+		return nil
+	}
+	bucket := viper.Get("bucket").(string)
+	hash, err := hashObject(bucket, storedKey, generation)
+	if err == nil {
+		err = updateState(func(state *tresor.VaultState) {
+			state.Set(storedKey, generation, hash)
+		})
+	}
+	if err != nil {
+		return stateNotUpdated(name, err)
+	}
+	return nil
+}
+
+// objectFormat selects the format for a key by the longest matching prefix in
+// 'prefix_formats', falling back to the vault's 'format'
+func objectFormat(key string) (string, error) {
+	var prefixFormats []struct {
+		Prefix string
+		Format string
+	}
+	if err := viper.UnmarshalKey("prefix_formats", &prefixFormats); err != nil {
+		return "", fmt.Errorf("failed to read 'prefix_formats': %v", err)
+	}
+
+	format := viper.GetString("format")
+	if format == "" {
+		format = tresor.FormatOpenPGP
+	}
+
+	longest := -1
+	for _, prefixFormat := range prefixFormats {
+		if strings.HasPrefix(key, prefixFormat.Prefix) && len(prefixFormat.Prefix) > longest {
+			format = prefixFormat.Format
+			longest = len(prefixFormat.Prefix)
+		}
+	}
+	return format, tresor.CheckFormat(format)
+}
+
+// encryptionCrypto loads the keys to encrypt objects in a format and creates the matching metadata
+func encryptionCrypto(format string) (tresor.Crypto, storage.ObjectAttrsToUpdate, error) {
+	armored := viper.Get("ascii_armor").(bool)
+
+	if format == tresor.FormatAge {
+		recipients, err := tresor.ParseAgeRecipients(viper.GetStringSlice("age_recipients"))
+		if err != nil {
+			return nil, storage.ObjectAttrsToUpdate{}, err
+		}
+		encryptor := &tresor.AgeCrypto{Recipients: recipients, Armored: armored}
+		return encryptor, tresor.CreateAgeMetadata(armored), nil
+	}
+
+	recipients, err := loadRecipients(extraRecipients)
+	if err != nil {
+		return nil, storage.ObjectAttrsToUpdate{}, err
+	}
+
+	var signer *openpgp.Entity
+
+	// Sign object if configured
+	if viper.Get("object_signing").(bool) {
+		if signer, err = loadSigner(); err != nil {
+			return nil, storage.ObjectAttrsToUpdate{}, err
+		}
+	}
+	encryptor, meta := recipientCrypto(recipients, signer)
+	return encryptor, meta, nil
+}
+
+// recipientCrypto creates the OpenPGP encryption to recipients and the matching metadata
+func recipientCrypto(recipients openpgp.EntityList, signer *openpgp.Entity) (tresor.Crypto, storage.ObjectAttrsToUpdate) {
+	armored := viper.Get("ascii_armor").(bool)
+	settings := cryptoSettings()
+	encryptor := &tresor.OpenPGPCrypto{Recipients: recipients, Signer: signer, Armored: armored, Settings: settings}
+	return encryptor, tresor.CreateMetadata(recipients, signer, armored, settings)
+}
+
+// loadRecipients loads the public key, resolves additional recipients from the key directory
+// and checks all of them against the pinned keys
+func loadRecipients(extra []string) (openpgp.EntityList, error) {
+	recipient, err := tresor.LoadArmoredKey(viper.Get("public_key").(string))
+	if err != nil {
+		return nil, err
+	}
+	recipients := openpgp.EntityList{recipient}
+
+	if len(extra) > 0 {
+		published, err := resolveRecipients(viper.Get("bucket").(string), extra)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, published...)
+	}
+	if err = checkKeyPins(recipients...); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+// loadSigner loads and unlocks the private key to sign with, once
+func loadSigner() (*openpgp.Entity, error) {
+	if cachedSigner != nil {
+		return cachedSigner, nil
+	}
+	signer, err := tresor.LoadArmoredKey(viper.Get("private_key").(string))
+	if err != nil {
+		return nil, err
+	}
+	if err = tresor.UnlockPrivateKey(signer.PrivateKey); err != nil {
+		return nil, err
+	}
+	cachedSigner = signer
+	return signer, nil
+}
+
+// symmetricCrypto asks for the passphrase to encrypt an object with, or reads it from --passphrase-file,
+// and creates the matching metadata
+func symmetricCrypto() (tresor.Crypto, storage.ObjectAttrsToUpdate, error) {
+	armored := viper.Get("ascii_armor").(bool)
+	settings := cryptoSettings()
+
+	passphrase, err := newPassphrase(tresor.SymmetricKeyID, symmetricPassFile)
+	if err != nil {
+		return nil, storage.ObjectAttrsToUpdate{}, err
+	}
+	if len(passphrase) == 0 {
+		return nil, storage.ObjectAttrsToUpdate{}, fmt.Errorf("refusing to encrypt with an empty passphrase")
+	}
+
+	encryptor := &tresor.OpenPGPCrypto{Passphrase: passphrase, Armored: armored, Settings: settings}
+	return encryptor, tresor.CreateSymmetricMetadata(armored, settings), nil
+}
+
+// symmetricPrompt tells whether the passphrase of a symmetric object is prompted for
+func symmetricPrompt() bool {
+	return symmetricObject && symmetricPassFile == ""
+}
+
+// newPassphrase reads a passphrase to protect a key or object with from a file, if given, or
+// prompts for it and asks to confirm it. The passphrase source is never used, since it supplies
+// the passphrase of the private key.
+func newPassphrase(keyID string, location string) ([]byte, error) {
+	if location != "" {
+		location, err := homedir.Expand(location)
+		if err != nil {
+			return nil, err
+		}
+		return tresor.FilePassphrase(location)(keyID)
+	}
+	if !tresor.TerminalAvailable() {
+		return nil, fmt.Errorf("cannot prompt for the new passphrase for %s without a terminal. Read it from a file instead", keyID)
+	}
+	for {
+		passphrase, err := getSecret(fmt.Sprintf("Enter new passphrase for %s: ", keyID))
+		if err != nil {
+			return nil, err
+		}
+		confirmBytes, err := getSecret("Confirm passphrase to continue: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(passphrase) == string(confirmBytes) {
+			return passphrase, nil
+		}
+		fmt.Fprintln(os.Stderr, "Passphrases do not match.")
+	}
+}
+
+func readInput(localPath string, interactive bool, passphrasePrompt bool) ([]byte, error) {
 	// Read local file if flag given
 	if localPath != "" {
 		return ioutil.ReadFile(localPath)
@@ -103,9 +364,9 @@ func readInput(localPath string, interactive bool, objectSigning bool) ([]byte,
 			fmt.Fprintln(os.Stderr, "Inputs do not match.")
 		}
 	}
-	// Read from STDIN
-	if objectSigning {
-		return nil, fmt.Errorf("refusing to read both password and payload from STDIN. Turn off 'object_signing' or supply input differently")
+	// Read from STDIN, prompts are read from the terminal if there is one
+	if passphrasePrompt && !tresor.TerminalAvailable() {
+		return nil, fmt.Errorf("refusing to read the input from STDIN, since a passphrase has to be prompted for and there is no terminal. Configure a non-interactive 'passphrase_source', use --passphrase-file for --symmetric or read the input with --in")
 	}
 	fmt.Fprintln(os.Stderr, "Reading from STDIN...")
 	return ioutil.ReadAll(os.Stdin)
@@ -113,7 +374,7 @@ func readInput(localPath string, interactive bool, objectSigning bool) ([]byte,
 
 func getSecret(prompt string) ([]byte, error) {
 	fmt.Fprintf(os.Stderr, "%s", prompt)
-	plainBytes, err := terminal.ReadPassword(int(syscall.Stdin))
+	plainBytes, err := tresor.ReadTerminalSecret()
 	fmt.Fprintln(os.Stderr, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get secret from prompt: %v", err)
@@ -121,8 +382,57 @@ func getSecret(prompt string) ([]byte, error) {
 	return plainBytes, nil
 }
 
+// objectPadding reads the padding applied to objects of a format. Compression would shrink the
+// padding again, so it is not padded.
+func objectPadding(format string) *tresor.Padding {
+	padding := &tresor.Padding{Scheme: viper.GetString("padding"), Block: viper.GetInt("padding_block")}
+	if format == tresor.FormatOpenPGP && padding.Enabled() && !strings.EqualFold(cryptoSettings().Compression, "none") {
+		fmt.Fprintln(os.Stderr, "Warning: 'padding' has no effect with compression, object is not padded.")
+		return &tresor.Padding{Scheme: tresor.PaddingNone}
+	}
+	return padding
+}
+
+// cryptoSettings reads the algorithm settings from the 'crypto' section and flags
+func cryptoSettings() *tresor.CryptoSettings {
+	settings := tresor.DefaultCryptoSettings()
+	if cipher := viper.GetString("crypto.cipher"); cipher != "" {
+		settings.Cipher = cipher
+	}
+	if hash := viper.GetString("crypto.hash"); hash != "" {
+		settings.Hash = hash
+	}
+	if compression := viper.GetString("crypto.compression"); compression != "" {
+		settings.Compression = compression
+	}
+	if mode := viper.GetString("crypto.s2k_mode"); mode != "" {
+		settings.S2KMode = mode
+	}
+	settings.CompressionLevel = viper.GetInt("crypto.compression_level")
+	settings.AEAD = viper.GetBool("crypto.aead")
+	settings.S2KCount = viper.GetInt("crypto.s2k_count")
+	return settings
+}
+
 func init() {
 	rootCmd.AddCommand(putCmd)
 	putCmd.Flags().StringVarP(&localReadPath, "in", "i", "", "Input file to read from.")
 	putCmd.Flags().BoolVarP(&interactivePrompt, "prompt", "p", false, "Use an interactive prompt for input.")
+	putCmd.Flags().StringSliceVarP(&extraRecipients, "to", "t", nil, "Also encrypt to keys published in the vault, by email or fingerprint.")
+	putCmd.Flags().BoolVar(&symmetricObject, "symmetric", false, "Encrypt with a passphrase instead of the public key.")
+	putCmd.Flags().StringVar(&symmetricPassFile, "passphrase-file", "", "File to read the passphrase for --symmetric from, instead of prompting for it.")
+	putCmd.Flags().StringVar(&cipherAlgorithm, "cipher", "", "Cipher to encrypt with: aes128 or aes256.")
+	putCmd.Flags().StringVar(&hashAlgorithm, "hash", "", "Hash to sign with: sha256, sha384, sha512, sha3-256 or sha3-512.")
+	putCmd.Flags().StringVar(&compressionAlgo, "compression", "", "Compression algorithm: none, zip or zlib.")
+	putCmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "Compression level from 1 to 9.")
+	putCmd.Flags().BoolVar(&aeadEncryption, "aead", false, "Use AEAD encryption if the recipient supports it.")
+	putCmd.Flags().StringVar(&s2kMode, "s2k-mode", "", "S2K for passphrase-derived keys: iterated or argon2.")
+	putCmd.Flags().IntVar(&s2kCount, "s2k-count", 0, "Iterations of the iterated S2K.")
+	viper.BindPFlag("crypto.cipher", putCmd.Flags().Lookup("cipher"))
+	viper.BindPFlag("crypto.hash", putCmd.Flags().Lookup("hash"))
+	viper.BindPFlag("crypto.compression", putCmd.Flags().Lookup("compression"))
+	viper.BindPFlag("crypto.compression_level", putCmd.Flags().Lookup("compression-level"))
+	viper.BindPFlag("crypto.aead", putCmd.Flags().Lookup("aead"))
+	viper.BindPFlag("crypto.s2k_mode", putCmd.Flags().Lookup("s2k-mode"))
+	viper.BindPFlag("crypto.s2k_count", putCmd.Flags().Lookup("s2k-count"))
 }
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	tresor "github.com/helloworlddan/tresor/lib"
 	"github.com/spf13/cobra"
@@ -17,11 +18,54 @@ var rmCmd = &cobra.Command{
 		if len(args) != 1 {
 			fail(fmt.Errorf("no object key specified"))
 		}
-		key := args[0]
+		key, err := storageName(args[0])
+		if err != nil {
+			fail(err)
+		}
+
+		bucket := viper.Get("bucket").(string)
+		generation, err := tresor.ObjectGeneration(bucket, key)
+		if err != nil {
+			fail(err)
+		}
 
-		if err := tresor.RemoveObject(viper.Get("bucket").(string), key); err != nil {
+		// Index entries of objects that are not stored are left over from failed puts and removals
+		if generation == 0 && cachedIndex != nil {
+			cachedIndex.Remove(args[0])
+			if err = saveIndex(cachedIndex); err != nil {
+				fail(err)
+			}
+			fmt.Fprintf(os.Stderr, "%s is not stored, removed it from the index\n", args[0])
+			return
+		}
+		if err := tresor.RemoveObject(bucket, key); err != nil {
 			fail(err)
 		}
+
+		// The object is gone, so record the removal everywhere before reporting a stale state
+		stateErr := updateState(func(state *tresor.VaultState) {
+			state.Remove(key)
+		})
+		if stateErr != nil {
+			stateErr = stateNotUpdated(args[0], stateErr)
+		}
+		if err = appendAudit("rm", key, "", generation); err != nil {
+			fail(err)
+		}
+		if err = recordDeletion(args[0], generation); err != nil {
+			fail(err)
+		}
+
+		// Forget the object in the index only once it is gone
+		if cachedIndex != nil {
+			cachedIndex.Remove(args[0])
+			if err = saveIndex(cachedIndex); err != nil {
+				fail(err)
+			}
+		}
+		if stateErr != nil {
+			fail(stateErr)
+		}
 	},
 }
 
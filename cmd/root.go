@@ -1,15 +1,27 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
+	tresor "github.com/helloworlddan/tresor/lib"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
+const (
+	exitFailure            = 1
+	exitBadPassphrase      = 2
+	exitVerificationFailed = 3
+)
+
+var (
+	cfgFile          string
+	passphraseSource string
+	passphraseFd     int
+)
 
 var rootCmd = &cobra.Command{
 	Use:   "tresor",
@@ -27,6 +39,10 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.tresor.yaml)")
+	rootCmd.PersistentFlags().StringVar(&passphraseSource, "passphrase-source", "", "Where to read private key passphrases from: terminal, env, fd, file, command, pinentry or none.")
+	rootCmd.PersistentFlags().IntVar(&passphraseFd, "passphrase-fd", 0, "File descriptor to read the passphrase from (implies --passphrase-source fd).")
+	viper.BindPFlag("passphrase_source", rootCmd.PersistentFlags().Lookup("passphrase-source"))
+	viper.BindPFlag("passphrase_fd", rootCmd.PersistentFlags().Lookup("passphrase-fd"))
 }
 func initConfig() {
 	if cfgFile != "" {
@@ -47,9 +63,90 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err != nil {
 		fail(fmt.Errorf("failed to read config: %v", viper.ConfigFileUsed()))
 	}
+
+	provider, err := passphraseProvider()
+	if err != nil {
+		fail(err)
+	}
+	tresor.SetPassphraseProvider(provider)
+
+	// Asking a non-interactive source again yields the same passphrase
+	retries := 1
+	if interactivePassphrase() || viper.GetString("passphrase_source") == "pinentry" {
+		retries = 3
+		if viper.IsSet("passphrase_retries") {
+			retries = viper.GetInt("passphrase_retries")
+		}
+	}
+	tresor.SetPassphraseRetries(retries)
+
+	socket, err := agentSocketPath()
+	if err != nil {
+		fail(err)
+	}
+	tresor.SetAgentSocket(socket)
+}
+
+// passphraseProvider selects the configured source for private key passphrases
+func passphraseProvider() (tresor.PassphraseProvider, error) {
+	source := viper.GetString("passphrase_source")
+	if source == "" && viper.GetInt("passphrase_fd") != 0 {
+		source = "fd"
+	}
+
+	switch source {
+	case "", "terminal":
+		return tresor.TerminalPassphrase, nil
+	case "none":
+		return tresor.NoPassphrase, nil
+	case "env":
+		name := viper.GetString("passphrase_env")
+		if name == "" {
+			name = "TRESOR_PASSPHRASE"
+		}
+		return tresor.EnvPassphrase(name), nil
+	case "fd":
+		fd := viper.GetInt("passphrase_fd")
+		if fd <= 0 {
+			return nil, fmt.Errorf("passphrase source 'fd' requires 'passphrase_fd'")
+		}
+		return tresor.FileDescriptorPassphrase(uintptr(fd)), nil
+	case "file":
+		location := viper.GetString("passphrase_file")
+		if location == "" {
+			return nil, fmt.Errorf("passphrase source 'file' requires 'passphrase_file'")
+		}
+		location, err := homedir.Expand(location)
+		if err != nil {
+			return nil, err
+		}
+		return tresor.FilePassphrase(location), nil
+	case "command":
+		command := viper.GetString("passphrase_command")
+		if command == "" {
+			return nil, fmt.Errorf("passphrase source 'command' requires 'passphrase_command'")
+		}
+		return tresor.CommandPassphrase(command), nil
+	case "pinentry":
+		program := viper.GetString("passphrase_command")
+		if program == "" {
+			program = "pinentry"
+		}
+		return tresor.PinentryPassphrase(program), nil
+	}
+	return nil, fmt.Errorf("unknown passphrase source: %s", source)
+}
+
+// interactivePassphrase reports whether passphrases are read from the terminal
+func interactivePassphrase() bool {
+	source := viper.GetString("passphrase_source")
+	return (source == "" && viper.GetInt("passphrase_fd") == 0) || source == "terminal"
 }
 
 func fail(err error) {
 	fmt.Fprintf(os.Stderr, "error: %v\n", err)
-	os.Exit(1)
+	if errors.Is(err, tresor.ErrBadPassphrase) {
+		os.Exit(exitBadPassphrase)
+	}
+	os.Exit(exitFailure)
 }
@@ -4,9 +4,7 @@ import (
 	"fmt"
 	"strings"
 
-	tresor "github.com/helloworlddan/tresor/lib"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"github.com/xlab/treeprint"
 )
 
@@ -21,14 +19,14 @@ var treeCmd = &cobra.Command{
 			prefixFilter = args[0]
 		}
 
-		attrs, err := tresor.QueryStorage(viper.Get("bucket").(string), prefixFilter, false)
+		names, err := listNames(prefixFilter)
 		if err != nil {
 			fail(err)
 		}
 
 		root := treeprint.New()
-		for _, attr := range attrs {
-			attach(root, attr.Name)
+		for _, name := range names {
+			attach(root, name)
 		}
 		fmt.Println(root.String())
 	},
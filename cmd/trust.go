@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	tresor "github.com/helloworlddan/tresor/lib"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var cachedPins *tresor.KeyPins
+
+var trustCmd = &cobra.Command{
+	Use:   "trust [identity fingerprint]",
+	Short: "Accept a new key for an identity.",
+	Long: `Accept a new key for an identity.
+
+Tresor pins the key fingerprint first seen for every identity of recipients and signers,
+per vault. If a different key shows up later, tresor refuses to use it until it is trusted
+with this command. Verify the new fingerprint with its owner first. Without arguments,
+all pinned identities of the vault are listed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 0 && len(args) != 2 {
+			fail(fmt.Errorf("specify an identity and the fingerprint of its new key"))
+		}
+		vault := viper.Get("bucket").(string)
+
+		pins, err := loadKeyPins()
+		if err != nil {
+			fail(err)
+		}
+
+		if len(args) == 0 {
+			for _, identity := range pins.Identities(vault) {
+				fingerprint, _ := pins.Lookup(vault, identity)
+				fmt.Printf("%s\t%s\n", fingerprint, identity)
+			}
+			return
+		}
+
+		identity, fingerprint := args[0], tresor.NormalizeFingerprint(args[1])
+		previous, ok := pins.Lookup(vault, identity)
+		pins.Trust(vault, identity, fingerprint)
+		if err = pins.Save(); err != nil {
+			fail(err)
+		}
+
+		if ok && previous != fingerprint {
+			fmt.Fprintf(os.Stderr, "Trusted key %s for %s, replacing %s\n", fingerprint, identity, previous)
+		} else {
+			fmt.Fprintf(os.Stderr, "Trusted key %s for %s\n", fingerprint, identity)
+		}
+	},
+}
+
+// checkKeyPins makes sure the keys are the ones pinned for their identities in the vault,
+// pinning identities seen for the first time
+func checkKeyPins(entities ...*openpgp.Entity) error {
+	vault := viper.Get("bucket").(string)
+
+	pins, err := loadKeyPins()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, entity := range entities {
+		pinned, err := pins.Check(vault, entity)
+		var keyChanged *tresor.KeyChangedError
+		if errors.As(err, &keyChanged) {
+			warnChangedKey(keyChanged)
+			return fmt.Errorf("%v. After verifying the new fingerprint with its owner, run 'tresor trust %s %s'", err, keyChanged.Identity, keyChanged.Presented)
+		}
+		if err != nil {
+			return err
+		}
+		for _, identity := range pinned {
+			fmt.Fprintf(os.Stderr, "Pinned key %s for %s on first use.\n", tresor.Fingerprint(entity), identity)
+			changed = true
+		}
+	}
+
+	if changed {
+		return pins.Save()
+	}
+	return nil
+}
+
+// checkSignerPin makes sure a known signer is the key pinned for its identities
+func checkSignerPin(signature *tresor.Signature) error {
+	if signature == nil || signature.Signer == nil {
+		return nil
+	}
+	return checkKeyPins(signature.Signer)
+}
+
+// loadKeyPins loads the key pins once
+func loadKeyPins() (*tresor.KeyPins, error) {
+	if cachedPins != nil {
+		return cachedPins, nil
+	}
+	location, err := keyPinsPath()
+	if err != nil {
+		return nil, err
+	}
+	if cachedPins, err = tresor.LoadKeyPins(location); err != nil {
+		return nil, err
+	}
+	return cachedPins, nil
+}
+
+func warnChangedKey(changed *tresor.KeyChangedError) {
+	fmt.Fprintln(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintf(os.Stderr, "WARNING: THE KEY FOR %s HAS CHANGED!\n", strings.ToUpper(changed.Identity))
+	fmt.Fprintln(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintf(os.Stderr, "Pinned:    %s\n", changed.Pinned)
+	fmt.Fprintf(os.Stderr, "Presented: %s\n", changed.Presented)
+	fmt.Fprintln(os.Stderr, "Someone may have replaced the key. Verify the fingerprint with")
+	fmt.Fprintln(os.Stderr, "its owner before trusting it.")
+}
+
+// keyPinsPath returns the configured or default location of the key pins
+func keyPinsPath() (string, error) {
+	if location := viper.GetString("key_pins"); location != "" {
+		return homedir.Expand(location)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".tresor-pins.json"), nil
+}
+
+func init() {
+	rootCmd.AddCommand(trustCmd)
+}
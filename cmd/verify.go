@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	tresor "github.com/helloworlddan/tresor/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify integrity and signatures of remote objects.",
+	Long: `Verify integrity and signatures of remote objects.
+
+Every object matching the key or prefix is decrypted and verified against the
+configured signature policy. Like get, the content is checked against its
+encrypted header, which has to name the object, and the object must not have
+been rolled back. The plaintext is discarded. Exits with status 3 if any object
+fails verification.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Check for correct number of arguments
+		if len(args) != 1 {
+			fail(fmt.Errorf("no object key or prefix specified"))
+		}
+
+		objects, err := matchObjects(viper.Get("bucket").(string), args[0])
+		if err != nil {
+			fail(err)
+		}
+
+		failed := 0
+		for _, attrs := range objects {
+			report, err := verifyObject(viper.Get("bucket").(string), attrs)
+			if errors.Is(err, tresor.ErrBadPassphrase) {
+				fail(err)
+			}
+			printReport(displayName(attrs.Name), report, err)
+			if err != nil {
+				failed++
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "%d object(s) verified, %d failed\n", len(objects)-failed, failed)
+		if failed > 0 {
+			os.Exit(exitVerificationFailed)
+		}
+	},
+}
+
+// matchObjects returns the object with the exact key or all objects below the prefix
+func matchObjects(bucketName string, keyOrPrefix string) ([]*storage.ObjectAttrs, error) {
+	if obfuscatedNames() {
+		return matchIndexedObjects(bucketName, keyOrPrefix)
+	}
+
+	found, err := tresor.QueryStorage(bucketName, keyOrPrefix, false)
+	if err != nil {
+		return nil, err
+	}
+	var attrs []*storage.ObjectAttrs
+	for _, attr := range found {
+		if attr.Name == keyOrPrefix {
+			return []*storage.ObjectAttrs{attr}, nil
+		}
+		if tresor.StateObjectName(attr.Name) {
+			attrs = append(attrs, attr)
+		}
+	}
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("no objects found for: %s", keyOrPrefix)
+	}
+	return attrs, nil
+}
+
+// matchIndexedObjects returns the object with the exact name or all objects below the prefix from the index
+func matchIndexedObjects(bucketName string, nameOrPrefix string) ([]*storage.ObjectAttrs, error) {
+	index, err := loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	names := index.Names(nameOrPrefix)
+	if _, ok := index.Lookup(nameOrPrefix); ok {
+		names = []string{nameOrPrefix}
+	}
+
+	// Index entries of objects that are not stored are skipped
+	var objects []*storage.ObjectAttrs
+	for _, name := range names {
+		stored, _ := index.Lookup(name)
+		attrs, err := tresor.ReadMetadata(bucketName, stored, 0)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, attrs)
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("no objects found for: %s", nameOrPrefix)
+	}
+	return objects, nil
+}
+
+func verifyObject(bucketName string, attrs *storage.ObjectAttrs) (*tresor.Report, error) {
+	decryptor, err := decryptionCrypto(attrs.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := tresor.OpenObject(bucketName, attrs.Name, attrs.Generation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	defer reader.Close()
+
+	// Check the plaintext against the encrypted header without keeping it
+	checker := &tresor.HeaderChecker{}
+	report, err := decryptor.Verify(reader, checker)
+	if err != nil {
+		return report, err
+	}
+	if report.Integrity == "none" {
+		return report, fmt.Errorf("object has no integrity protection")
+	}
+	if err = checkSignerPin(report.Signature); err != nil {
+		return report, err
+	}
+	name := displayName(attrs.Name)
+	if _, err = checkMetadata(name, attrs, report.Signature); err != nil {
+		return report, err
+	}
+
+	header, err := checker.Header()
+	if err != nil {
+		return report, err
+	}
+	if err = checkObjectName(name, header); err != nil {
+		return report, err
+	}
+	return report, checkRollback(name, attrs, header)
+}
+
+// checkMetadata verifies the signature over the metadata of an object against the signature policy.
+// Signed metadata has to be signed by the same key as the object, if the object was decrypted.
+func checkMetadata(name string, attrs *storage.ObjectAttrs, objectSignature *tresor.Signature) (*tresor.Signature, error) {
+	policy := signaturePolicy("")
+	if _, signed := attrs.Metadata[tresor.MetadataSignature]; !signed {
+		// Metadata of signed objects is always signed, so the signature was removed
+		if objectSignature != nil && objectSignature.Signed {
+			return nil, fmt.Errorf("metadata of %s is not signed, but the object is signed by %s. The signature may have been removed, check the object and run 'tresor fsck --repair' if it was stored by an older version", name, objectSignature.Identity())
+		}
+		if policy.RequireSignature {
+			return nil, fmt.Errorf("metadata of %s is not signed, but a signature is required", name)
+		}
+		return &tresor.Signature{}, nil
+	}
+
+	ring, err := cachedRing()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := tresor.VerifyMetadata(ring, name, attrs)
+	if err != nil {
+		return nil, fmt.Errorf("metadata of %s may have been tampered with: %v", name, err)
+	}
+
+	if objectSignature != nil && !sameSigner(signature, objectSignature) {
+		return nil, fmt.Errorf("metadata of %s is signed by %s, but the object by %s", name, signature.Identity(), objectSignature.Identity())
+	}
+	if err = policy.Verify(signature); err != nil {
+		return nil, fmt.Errorf("failed to verify metadata of %s: %v", name, err)
+	}
+	return signature, checkSignerPin(signature)
+}
+
+func sameSigner(a *tresor.Signature, b *tresor.Signature) bool {
+	if a.Signer != nil && b.Signer != nil {
+		return a.Fingerprint() == b.Fingerprint()
+	}
+	return a.Signed == b.Signed && a.KeyID == b.KeyID
+}
+
+func printReport(name string, report *tresor.Report, err error) {
+	if err != nil {
+		fmt.Printf("FAILED\t%s\n", name)
+	} else {
+		fmt.Printf("OK\t%s\n", name)
+	}
+
+	if report != nil {
+		if report.Signature != nil {
+			fmt.Printf("\tSigner\t\t%s\n", report.Signature.Identity())
+		}
+		var recipients []string
+		for _, keyID := range report.Recipients {
+			recipients = append(recipients, fmt.Sprintf("%016X", keyID))
+		}
+		if len(recipients) > 0 {
+			fmt.Printf("\tRecipients\t%s\n", strings.Join(recipients, ", "))
+		}
+		if report.Symmetric {
+			fmt.Printf("\tPassphrase\tyes\n")
+		}
+		if report.DecryptedWith != 0 {
+			fmt.Printf("\tDecrypted\t%016X\n", report.DecryptedWith)
+		}
+		fmt.Printf("\tIntegrity\t%s\n", report.Integrity)
+	}
+
+	if err != nil {
+		fmt.Printf("\tError\t\t%v\n", err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
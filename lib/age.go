@@ -0,0 +1,216 @@
+package tresor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// AgeCrypto implements Crypto using age files. age does not sign files, so decrypted
+// objects are always reported as unsigned.
+type AgeCrypto struct {
+	Recipients []age.Recipient
+	Identities []age.Identity
+	Armored    bool
+	Policy     *SignaturePolicy
+}
+
+// Format implements Crypto
+func (c *AgeCrypto) Format() string {
+	return FormatAge
+}
+
+// Encrypt implements Crypto
+func (c *AgeCrypto) Encrypt(plainBytes []byte) ([]byte, error) {
+	cryptoBuffer := bytes.NewBuffer(nil)
+
+	var output io.WriteCloser = nopWriteCloser{cryptoBuffer}
+	if c.Armored {
+		output = armor.NewWriter(cryptoBuffer)
+	}
+
+	cryptoWriter, err := age.Encrypt(output, c.Recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream writer: %v", err)
+	}
+	if _, err = cryptoWriter.Write(plainBytes); err != nil {
+		return nil, fmt.Errorf("failed to write stream: %v", err)
+	}
+	if err = cryptoWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close stream: %v", err)
+	}
+	if err = output.Close(); err != nil {
+		return nil, fmt.Errorf("failed to armor stream: %v", err)
+	}
+	return cryptoBuffer.Bytes(), nil
+}
+
+// Decrypt implements Crypto
+func (c *AgeCrypto) Decrypt(payload []byte) ([]byte, *Signature, error) {
+	plainBuffer := bytes.NewBuffer(nil)
+	report, err := c.decryptStream(bytes.NewReader(payload), plainBuffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plainBuffer.Bytes(), report.Signature, nil
+}
+
+// Verify decrypts an age file and checks it against the signature policy, writing the plaintext to plain
+func (c *AgeCrypto) Verify(reader io.Reader, plain io.Writer) (*Report, error) {
+	return c.decryptStream(reader, plain)
+}
+
+func (c *AgeCrypto) decryptStream(reader io.Reader, plain io.Writer) (*Report, error) {
+	report := &Report{Integrity: "ChaCha20-Poly1305"}
+	buffered := bufio.NewReader(reader)
+
+	var input io.Reader = buffered
+	if start, _ := buffered.Peek(len(armor.Header)); string(start) == armor.Header {
+		report.Armored = true
+		input = armor.NewReader(buffered)
+	}
+
+	plainReader, err := age.Decrypt(input, c.Identities...)
+	if err != nil {
+		return report, fmt.Errorf("failed to read age file: %v", err)
+	}
+	if report.Size, err = io.Copy(plain, plainReader); err != nil {
+		return report, fmt.Errorf("failed to read age data: %v", err)
+	}
+
+	report.Signature = &Signature{}
+	if c.Policy != nil {
+		if err = c.Policy.Verify(report.Signature); err != nil {
+			return report, fmt.Errorf("failed to verify signature: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// ParseAgeRecipients parses age and SSH public keys, given inline or as files with one key per line
+func ParseAgeRecipients(values []string) (recipients []age.Recipient, err error) {
+	for _, value := range values {
+		lines := []string{value}
+		if !strings.HasPrefix(value, "age1") && !strings.HasPrefix(value, "ssh-") {
+			content, err := ioutil.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read age recipients: %v", err)
+			}
+			lines = strings.Split(string(content), "\n")
+		}
+
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			recipient, err := parseAgeRecipient(line)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients configured")
+	}
+	return recipients, nil
+}
+
+func parseAgeRecipient(line string) (age.Recipient, error) {
+	if strings.HasPrefix(line, "ssh-") {
+		recipient, err := agessh.ParseRecipient(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH recipient: %v", err)
+		}
+		return recipient, nil
+	}
+
+	recipient, err := age.ParseX25519Recipient(line)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age recipient: %v", err)
+	}
+	return recipient, nil
+}
+
+// LoadAgeIdentities loads age identity files and SSH private keys from local disk
+func LoadAgeIdentities(locations []string) (identities []age.Identity, err error) {
+	for _, location := range locations {
+		content, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read age identity: %v", err)
+		}
+
+		if !bytes.Contains(content, []byte("-----BEGIN")) {
+			parsed, err := age.ParseIdentities(bytes.NewReader(content))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse age identity %s: %v", location, err)
+			}
+			identities = append(identities, parsed...)
+			continue
+		}
+
+		identity, err := loadSSHIdentity(location, content)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identities configured")
+	}
+	return identities, nil
+}
+
+func loadSSHIdentity(location string, content []byte) (age.Identity, error) {
+	identity, err := agessh.ParseIdentity(content)
+	if err == nil {
+		return identity, nil
+	}
+
+	// Encrypted keys are unlocked only once they are actually needed
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("failed to parse SSH identity %s: %v", location, err)
+	}
+	if missing.PublicKey == nil {
+		publicKey, err := loadSSHPublicKey(location + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find public key for encrypted SSH identity %s: %v", location, err)
+		}
+		missing.PublicKey = publicKey
+	}
+
+	passphrase := func() ([]byte, error) {
+		return GetUserPassword(ssh.FingerprintSHA256(missing.PublicKey))
+	}
+	return agessh.NewEncryptedSSHIdentity(missing.PublicKey, content, passphrase)
+}
+
+func loadSSHPublicKey(location string) (ssh.PublicKey, error) {
+	content, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	return publicKey, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,395 @@
+package tresor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	agentHas     = "has"
+	agentPut     = "put"
+	agentDecrypt = "decrypt"
+	agentSign    = "sign"
+	agentEncrypt = "encrypt"
+	agentForget  = "forget"
+	agentLock    = "lock"
+
+	// Encrypting large objects in the agent takes a while
+	agentTimeout = time.Minute
+)
+
+var agentSocket string
+
+type agentRequest struct {
+	Op         string          `json:"op"`
+	KeyID      string          `json:"key_id,omitempty"`
+	Key        []byte          `json:"key,omitempty"`        // Unlocked private key packet to hold
+	Packet     []byte          `json:"packet,omitempty"`     // Encrypted session key packet to decrypt
+	Signer     []byte          `json:"signer,omitempty"`     // Public key of the signer
+	Recipients []byte          `json:"recipients,omitempty"` // Public keys to encrypt to
+	Data       []byte          `json:"data,omitempty"`       // Data to sign or encrypt
+	Armored    bool            `json:"armored,omitempty"`
+	Settings   *CryptoSettings `json:"settings,omitempty"`
+}
+
+type agentResponse struct {
+	Held       bool   `json:"held,omitempty"`
+	Cipher     uint8  `json:"cipher,omitempty"`
+	SessionKey []byte `json:"session_key,omitempty"`
+	Data       []byte `json:"data,omitempty"` // Signature or encrypted data
+	Error      string `json:"error,omitempty"`
+}
+
+type agentEntry struct {
+	key     *packet.PrivateKey
+	expires time.Time
+}
+
+type agentCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]*agentEntry
+}
+
+// SetAgentSocket configures the socket of a running agent holding unlocked keys
+func SetAgentSocket(socket string) {
+	agentSocket = socket
+}
+
+// ServeAgent holds unlocked private keys in memory and decrypts and signs with them for clients
+// on a Unix socket. Neither the keys nor their passphrases are ever handed out, so nothing a
+// client obtains outlives the agent or the TTL: decrypted session keys only open a single
+// message. Any process running as the owner can still have the agent decrypt and sign while
+// it holds a key.
+func ServeAgent(socket string, ttl time.Duration) error {
+	if _, err := os.Stat(socket); err == nil {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return fmt.Errorf("agent is already running on %s", socket)
+		}
+		// Remove stale socket left by a previous agent
+		if err = os.Remove(socket); err != nil {
+			return fmt.Errorf("failed to remove stale agent socket: %v", err)
+		}
+	}
+
+	listener, err := listenAgent(socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on agent socket: %v", err)
+	}
+	defer listener.Close()
+
+	cache := newAgentCache(ttl)
+	defer cache.lock()
+
+	go func() {
+		for range time.Tick(time.Second) {
+			cache.expire()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept agent connection: %v", err)
+		}
+		go cache.handle(conn)
+	}
+}
+
+// LockAgent wipes all unlocked keys held by the agent
+func LockAgent(socket string) error {
+	_, err := callAgent(socket, agentRequest{Op: agentLock})
+	return err
+}
+
+// agentHolds tells whether a running agent holds the unlocked private key with the given ID
+func agentHolds(keyID string) bool {
+	if agentSocket == "" {
+		return false
+	}
+	response, err := callAgent(agentSocket, agentRequest{Op: agentHas, KeyID: keyID})
+	return err == nil && response.Held
+}
+
+// agentStore hands an unlocked private key to the agent, if one is running
+func agentStore(key *packet.PrivateKey) {
+	if agentSocket == "" || key.Encrypted {
+		return
+	}
+	serialized := bytes.NewBuffer(nil)
+	if err := key.Serialize(serialized); err != nil {
+		return
+	}
+	callAgent(agentSocket, agentRequest{Op: agentPut, Key: serialized.Bytes()})
+	wipe(serialized.Bytes())
+}
+
+// agentSessionKey has the agent decrypt the session key of a message
+func agentSessionKey(encryptedKey *packet.EncryptedKey) (packet.CipherFunction, []byte, error) {
+	serialized := bytes.NewBuffer(nil)
+	if err := encryptedKey.Serialize(serialized); err != nil {
+		return 0, nil, err
+	}
+	response, err := callRunningAgent(agentRequest{Op: agentDecrypt, Packet: serialized.Bytes()})
+	if err != nil {
+		return 0, nil, err
+	}
+	return packet.CipherFunction(response.Cipher), response.SessionKey, nil
+}
+
+// agentSignDetached has the agent create a base64 encoded detached signature over data
+func agentSignDetached(signer *openpgp.Entity, data []byte, settings *CryptoSettings) (string, error) {
+	signerBytes, err := serializePublic(openpgp.EntityList{signer})
+	if err != nil {
+		return "", err
+	}
+	response, err := callRunningAgent(agentRequest{Op: agentSign, Signer: signerBytes, Data: data, Settings: settings})
+	if err != nil {
+		return "", err
+	}
+	return string(response.Data), nil
+}
+
+// agentEncryptBytes has the agent encrypt a byte sequence to all recipients and sign it
+func agentEncryptBytes(recipients openpgp.EntityList, signer *openpgp.Entity, plainBytes []byte, armored bool, settings *CryptoSettings) ([]byte, error) {
+	signerBytes, err := serializePublic(openpgp.EntityList{signer})
+	if err != nil {
+		return nil, err
+	}
+	recipientBytes, err := serializePublic(recipients)
+	if err != nil {
+		return nil, err
+	}
+	request := agentRequest{Op: agentEncrypt, Signer: signerBytes, Recipients: recipientBytes, Data: plainBytes, Armored: armored, Settings: settings}
+	response, err := callRunningAgent(request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// ForgetAgentKey removes an unlocked key from the agent, if one is running. It is called once
+// the passphrase of the key was changed.
+func ForgetAgentKey(keyID string) {
+	if agentSocket == "" {
+		return
+	}
+	callAgent(agentSocket, agentRequest{Op: agentForget, KeyID: keyID})
+}
+
+func serializePublic(entities openpgp.EntityList) ([]byte, error) {
+	serialized := bytes.NewBuffer(nil)
+	for _, entity := range entities {
+		if err := entity.Serialize(serialized); err != nil {
+			return nil, fmt.Errorf("failed to serialize key %s: %v", entity.PrimaryKey.KeyIdString(), err)
+		}
+	}
+	return serialized.Bytes(), nil
+}
+
+func callRunningAgent(request agentRequest) (*agentResponse, error) {
+	if agentSocket == "" {
+		return nil, fmt.Errorf("agent is not running")
+	}
+	return callAgent(agentSocket, request)
+}
+
+func callAgent(socket string, request agentRequest) (*agentResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("agent is not running: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, fmt.Errorf("failed to send agent request: %v", err)
+	}
+
+	var response agentResponse
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read agent response: %v", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("agent: %s", response.Error)
+	}
+	return &response, nil
+}
+
+func newAgentCache(ttl time.Duration) *agentCache {
+	return &agentCache{ttl: ttl, entries: make(map[string]*agentEntry)}
+}
+
+func (c *agentCache) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	var request agentRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		return
+	}
+	defer wipe(request.Key)
+
+	var response agentResponse
+	var err error
+	switch request.Op {
+	case agentHas:
+		response.Held = c.get(request.KeyID) != nil
+	case agentPut:
+		err = c.put(request.Key)
+	case agentDecrypt:
+		var cipher packet.CipherFunction
+		cipher, response.SessionKey, err = c.decrypt(request.Packet)
+		response.Cipher = uint8(cipher)
+	case agentSign:
+		var signature string
+		signature, err = c.sign(request.Signer, request.Data, request.Settings)
+		response.Data = []byte(signature)
+	case agentEncrypt:
+		response.Data, err = c.encrypt(request)
+	case agentForget:
+		c.forget(request.KeyID)
+	case agentLock:
+		c.lock()
+	default:
+		err = fmt.Errorf("unknown operation: %s", request.Op)
+	}
+	if err != nil {
+		response = agentResponse{Error: err.Error()}
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+func (c *agentCache) get(keyID string) *packet.PrivateKey {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[keyID]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.key
+}
+
+// put holds a serialized private key, which has to be unlocked
+func (c *agentCache) put(serialized []byte) error {
+	parsed, err := packet.Read(bytes.NewReader(serialized))
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %v", err)
+	}
+	key, ok := parsed.(*packet.PrivateKey)
+	if !ok || key.Encrypted || key.Dummy() {
+		return fmt.Errorf("not an unlocked private key")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[key.KeyIdString()] = &agentEntry{key: key, expires: time.Now().Add(c.ttl)}
+	return nil
+}
+
+// decrypt decrypts the session key of a message with a held key
+func (c *agentCache) decrypt(serialized []byte) (packet.CipherFunction, []byte, error) {
+	parsed, err := packet.Read(bytes.NewReader(serialized))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read encrypted session key: %v", err)
+	}
+	encryptedKey, ok := parsed.(*packet.EncryptedKey)
+	if !ok {
+		return 0, nil, fmt.Errorf("not an encrypted session key")
+	}
+	keyID := fmt.Sprintf("%016X", encryptedKey.KeyId)
+	key := c.get(keyID)
+	if key == nil {
+		return 0, nil, fmt.Errorf("key %s is not unlocked", keyID)
+	}
+	if err = encryptedKey.Decrypt(key, nil); err != nil {
+		return 0, nil, fmt.Errorf("failed to decrypt session key: %v", err)
+	}
+	return encryptedKey.CipherFunc, encryptedKey.Key, nil
+}
+
+func (c *agentCache) sign(signerBytes []byte, data []byte, settings *CryptoSettings) (string, error) {
+	signer, err := c.entity(signerBytes)
+	if err != nil {
+		return "", err
+	}
+	return signDetached(signer, data, settings)
+}
+
+func (c *agentCache) encrypt(request agentRequest) ([]byte, error) {
+	signer, err := c.entity(request.Signer)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := openpgp.ReadKeyRing(bytes.NewReader(request.Recipients))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipients: %v", err)
+	}
+	return EncryptBytes(recipients, signer, request.Data, request.Armored, request.Settings)
+}
+
+// entity reads the public key of a signer and attaches the held private keys to it
+func (c *agentCache) entity(serialized []byte) (*openpgp.Entity, error) {
+	entity, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(serialized)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signer: %v", err)
+	}
+
+	held := false
+	if key := c.get(entity.PrimaryKey.KeyIdString()); key != nil {
+		entity.PrivateKey, held = key, true
+	}
+	for i := range entity.Subkeys {
+		if key := c.get(entity.Subkeys[i].PublicKey.KeyIdString()); key != nil {
+			entity.Subkeys[i].PrivateKey, held = key, true
+		}
+	}
+	if !held {
+		return nil, fmt.Errorf("key %s is not unlocked", entity.PrimaryKey.KeyIdString())
+	}
+	return entity, nil
+}
+
+func (c *agentCache) forget(keyID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, keyID)
+}
+
+// expire drops keys whose TTL has passed. Key material can't be overwritten for every algorithm,
+// so dropped keys are left to the garbage collector.
+func (c *agentCache) expire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for keyID, entry := range c.entries {
+		if time.Now().After(entry.expires) {
+			delete(c.entries, keyID)
+		}
+	}
+}
+
+func (c *agentCache) lock() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for keyID := range c.entries {
+		delete(c.entries, keyID)
+	}
+}
+
+func wipe(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
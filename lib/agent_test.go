@@ -0,0 +1,151 @@
+package tresor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// testEntity generates an unlocked key pair, quickly
+func testEntity(t *testing.T, name string, email string) *openpgp.Entity {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", email, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return entity
+}
+
+func serializedKey(t *testing.T, key *packet.PrivateKey) []byte {
+	t.Helper()
+	serialized := bytes.NewBuffer(nil)
+	if err := key.Serialize(serialized); err != nil {
+		t.Fatalf("failed to serialize key: %v", err)
+	}
+	return serialized.Bytes()
+}
+
+func TestAgentCacheExpiry(t *testing.T) {
+	entity := testEntity(t, "Alice", "alice@example.com")
+	keyID := entity.PrimaryKey.KeyIdString()
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		age     time.Duration // How long ago the key was stored
+		held    bool
+		expired bool // Whether expire drops the key
+	}{
+		{"fresh", time.Minute, 0, true, false},
+		{"within ttl", time.Minute, 30 * time.Second, true, false},
+		{"past ttl", time.Minute, 2 * time.Minute, false, true},
+		{"zero ttl", 0, time.Millisecond, false, true},
+	}
+	for _, test := range tests {
+		cache := newAgentCache(test.ttl)
+		if err := cache.put(serializedKey(t, entity.PrivateKey)); err != nil {
+			t.Fatalf("%s: put() failed: %v", test.name, err)
+		}
+		cache.entries[keyID].expires = cache.entries[keyID].expires.Add(-test.age)
+
+		if held := cache.get(keyID) != nil; held != test.held {
+			t.Errorf("%s: get() held = %v, want %v", test.name, held, test.held)
+		}
+		cache.expire()
+		if _, kept := cache.entries[keyID]; kept == test.expired {
+			t.Errorf("%s: expire() kept = %v, want %v", test.name, kept, !test.expired)
+		}
+	}
+}
+
+func TestAgentCachePut(t *testing.T) {
+	entity := testEntity(t, "Alice", "alice@example.com")
+	locked := testEntity(t, "Bob", "bob@example.com")
+	if err := locked.PrivateKey.Encrypt([]byte("secret")); err != nil {
+		t.Fatalf("failed to lock key: %v", err)
+	}
+	public := bytes.NewBuffer(nil)
+	if err := entity.PrimaryKey.Serialize(public); err != nil {
+		t.Fatalf("failed to serialize key: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		serialized []byte
+		ok         bool
+	}{
+		{"unlocked", serializedKey(t, entity.PrivateKey), true},
+		{"locked", serializedKey(t, locked.PrivateKey), false},
+		{"public", public.Bytes(), false},
+		{"garbage", []byte("garbage"), false},
+	}
+	for _, test := range tests {
+		cache := newAgentCache(time.Minute)
+		if err := cache.put(test.serialized); (err == nil) != test.ok {
+			t.Errorf("%s: put() error = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestAgentCacheLock(t *testing.T) {
+	alice := testEntity(t, "Alice", "alice@example.com")
+	bob := testEntity(t, "Bob", "bob@example.com")
+
+	cache := newAgentCache(time.Minute)
+	for _, key := range []*packet.PrivateKey{alice.PrivateKey, bob.PrivateKey} {
+		if err := cache.put(serializedKey(t, key)); err != nil {
+			t.Fatalf("put() failed: %v", err)
+		}
+	}
+	cache.forget(alice.PrimaryKey.KeyIdString())
+	if cache.get(alice.PrimaryKey.KeyIdString()) != nil || cache.get(bob.PrimaryKey.KeyIdString()) == nil {
+		t.Errorf("forget() did not drop only the forgotten key")
+	}
+	cache.lock()
+	if len(cache.entries) != 0 {
+		t.Errorf("lock() kept %d key(s)", len(cache.entries))
+	}
+}
+
+func TestAgentCacheHandle(t *testing.T) {
+	entity := testEntity(t, "Alice", "alice@example.com")
+	keyID := entity.PrimaryKey.KeyIdString()
+	cache := newAgentCache(time.Minute)
+
+	tests := []struct {
+		name    string
+		request agentRequest
+		held    bool
+		failed  bool
+	}{
+		{"not held yet", agentRequest{Op: agentHas, KeyID: keyID}, false, false},
+		{"put", agentRequest{Op: agentPut, Key: serializedKey(t, entity.PrivateKey)}, false, false},
+		{"held", agentRequest{Op: agentHas, KeyID: keyID}, true, false},
+		{"other key", agentRequest{Op: agentHas, KeyID: "0000000000000000"}, false, false},
+		{"lock", agentRequest{Op: agentLock}, false, false},
+		{"locked", agentRequest{Op: agentHas, KeyID: keyID}, false, false},
+		{"unknown", agentRequest{Op: "passphrase", KeyID: keyID}, false, true},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go cache.handle(server)
+
+		var response agentResponse
+		if err := json.NewEncoder(client).Encode(test.request); err != nil {
+			t.Fatalf("%s: failed to send request: %v", test.name, err)
+		}
+		if err := json.NewDecoder(client).Decode(&response); err != nil {
+			t.Fatalf("%s: failed to read response: %v", test.name, err)
+		}
+		client.Close()
+
+		if response.Held != test.held || (response.Error != "") != test.failed {
+			t.Errorf("%s: response = %+v, want held %v, failed %v", test.name, response, test.held, test.failed)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package tresor
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenAgent creates the agent socket with a umask that leaves it accessible by the owner only,
+// so it is never accessible by others, not even until its permissions are changed
+func listenAgent(socket string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", socket)
+}
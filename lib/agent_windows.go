@@ -0,0 +1,11 @@
+package tresor
+
+import (
+	"net"
+)
+
+// listenAgent creates the agent socket. Windows has no umask, sockets are protected by the ACL
+// of the directory they are created in.
+func listenAgent(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
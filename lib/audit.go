@@ -0,0 +1,281 @@
+package tresor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	// AuditLogPrefix is the prefix under which the entries of the audit log of a vault are stored
+	AuditLogPrefix = "_log/"
+	// AuditLogHead points to the last entry of the audit log, so entries are appended without listing the log
+	AuditLogHead = AuditLogPrefix + "HEAD"
+
+	auditAppendAttempts = 5
+)
+
+// AuditEntry records a change to a vault. Every entry is signed and refers to the hash of the
+// entry before it, so removed or changed entries break the chain.
+type AuditEntry struct {
+	Sequence   int64     `json:"sequence"`
+	Previous   string    `json:"previous"` // SHA-256 of the previous entry, empty for the first one
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Key        string    `json:"key"`
+	Source     string    `json:"source,omitempty"`     // Source key of copies
+	Generation int64     `json:"generation,omitempty"` // Generation written by the change, or removed by rm
+	Signer     string    `json:"signer"`               // Fingerprint of the signing key
+	Signature  string    `json:"signature,omitempty"`
+}
+
+// AuditRecord is an entry as it is stored in the audit log
+type AuditRecord struct {
+	Name  string // Object name
+	Hash  string // SHA-256 of the stored entry
+	Entry *AuditEntry
+}
+
+// auditHead is the sequence number and hash of the last entry of the audit log
+type auditHead struct {
+	Sequence int64  `json:"sequence"`
+	Hash     string `json:"hash"`
+}
+
+// auditEntryName returns the object name of an entry. Sequence numbers are padded, so entries are listed in order.
+func auditEntryName(sequence int64) string {
+	return fmt.Sprintf("%s%016d", AuditLogPrefix, sequence)
+}
+
+// signedBytes serializes the entry without its signature
+func (e *AuditEntry) signedBytes() ([]byte, error) {
+	unsigned := *e
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+// AppendAuditEntry signs an entry and appends it to the audit log. Entries are only ever created,
+// never overwritten, so concurrent changes are retried with the next sequence number. The head of
+// the log is moved to the new entry afterwards.
+func AppendAuditEntry(bucketName string, signer *openpgp.Entity, entry *AuditEntry, settings *CryptoSettings) error {
+	head, headGeneration, err := readAuditHead(bucketName)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		// Entries appended by writers that failed to move the head follow it
+		if head, err = auditLogEnd(bucketName, head); err != nil {
+			return err
+		}
+		payload, err := entry.seal(signer, head, settings)
+		if err != nil {
+			return err
+		}
+
+		_, err = WriteObjectIfGeneration(bucketName, auditEntryName(entry.Sequence), payload, 0)
+		if IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to append to audit log: %v", err)
+		}
+		digest := sha256.Sum256(payload)
+		moveAuditHead(bucketName, &auditHead{Sequence: entry.Sequence, Hash: hex.EncodeToString(digest[:])}, headGeneration)
+		return nil
+	}
+	return fmt.Errorf("failed to append to audit log: too many concurrent changes")
+}
+
+// seal chains the entry to the head of the log, nil for an empty log, and signs it. It returns
+// the entry as it is stored.
+func (e *AuditEntry) seal(signer *openpgp.Entity, head *auditHead, settings *CryptoSettings) ([]byte, error) {
+	e.Sequence, e.Previous = 1, ""
+	if head != nil {
+		e.Sequence, e.Previous = head.Sequence+1, head.Hash
+	}
+	e.Signer = Fingerprint(signer)
+	unsigned, err := e.signedBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	if e.Signature, err = signDetached(signer, unsigned, settings); err != nil {
+		return nil, fmt.Errorf("failed to sign audit entry: %v", err)
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	return payload, nil
+}
+
+// readAuditHead reads the head of the audit log and the generation it is stored at. Logs written
+// before the head was kept are listed once to find their last entry, at generation 0.
+func readAuditHead(bucketName string) (*auditHead, int64, error) {
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		attrs, err := ReadMetadata(bucketName, AuditLogHead, 0)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			last, err := lastAuditRecord(bucketName)
+			if err != nil || last == nil {
+				return nil, 0, err
+			}
+			return &auditHead{Sequence: last.Entry.Sequence, Hash: last.Hash}, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// The generation is gone if the head was moved in the meantime
+		payload, err := ReadObject(bucketName, AuditLogHead, attrs.Generation)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read audit log head: %v", err)
+		}
+		head := &auditHead{}
+		if err = json.Unmarshal(payload, head); err != nil {
+			return nil, 0, fmt.Errorf("failed to parse audit log head: %v", err)
+		}
+		return head, attrs.Generation, nil
+	}
+	return nil, 0, fmt.Errorf("failed to read audit log head: too many concurrent changes")
+}
+
+// auditLogEnd follows the entries after the head, which is nil for an empty log, up to the last one
+func auditLogEnd(bucketName string, head *auditHead) (*auditHead, error) {
+	for {
+		var sequence int64 = 1
+		if head != nil {
+			sequence = head.Sequence + 1
+		}
+		record, err := readAuditRecord(bucketName, auditEntryName(sequence))
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return head, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		head = &auditHead{Sequence: sequence, Hash: record.Hash}
+	}
+}
+
+// moveAuditHead points the head of the log to a new entry, unless a later entry moved it further.
+// The entry is appended already, so failures are ignored: a head left behind, for example by a
+// retention policy on the bucket, is followed to the last entry by the next append.
+func moveAuditHead(bucketName string, head *auditHead, generation int64) {
+	payload, err := json.Marshal(head)
+	if err != nil {
+		return
+	}
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		_, err = WriteObjectIfGeneration(bucketName, AuditLogHead, payload, generation)
+		if !IsConflict(err) {
+			return
+		}
+		current, currentGeneration, err := readAuditHead(bucketName)
+		if err != nil || (current != nil && current.Sequence >= head.Sequence) {
+			return
+		}
+		generation = currentGeneration
+	}
+}
+
+// lastAuditRecord lists the whole log to find its last entry, or nil for an empty log
+func lastAuditRecord(bucketName string) (*AuditRecord, error) {
+	attrs, err := QueryStorage(bucketName, AuditLogPrefix, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Name != AuditLogHead {
+			return readAuditRecord(bucketName, attrs[i].Name)
+		}
+	}
+	return nil, nil
+}
+
+func readAuditRecord(bucketName string, name string) (*AuditRecord, error) {
+	payload, err := ReadObject(bucketName, name, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit entry %s: %w", name, err)
+	}
+	return parseAuditRecord(name, payload)
+}
+
+// parseAuditRecord parses an entry as it is stored under a name
+func parseAuditRecord(name string, payload []byte) (*AuditRecord, error) {
+	entry := &AuditEntry{}
+	if err := json.Unmarshal(payload, entry); err != nil {
+		return nil, fmt.Errorf("failed to parse audit entry %s: %v", name, err)
+	}
+	digest := sha256.Sum256(payload)
+	return &AuditRecord{Name: name, Hash: hex.EncodeToString(digest[:]), Entry: entry}, nil
+}
+
+// ReadAuditLog reads all entries of the audit log in order
+func ReadAuditLog(bucketName string) ([]*AuditRecord, error) {
+	attrs, err := QueryStorage(bucketName, AuditLogPrefix, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*AuditRecord
+	for _, attr := range attrs {
+		if attr.Name == AuditLogHead {
+			continue
+		}
+		record, err := readAuditRecord(bucketName, attr.Name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Verify checks that a record is signed by the key it names and follows the record before it,
+// which is nil for the first record
+func (r *AuditRecord) Verify(ring openpgp.EntityList, previous *AuditRecord) (*Signature, error) {
+	sequence, err := strconv.ParseInt(strings.TrimPrefix(r.Name, AuditLogPrefix), 10, 64)
+	if err != nil || sequence != r.Entry.Sequence {
+		return nil, fmt.Errorf("entry %d is stored as %s", r.Entry.Sequence, r.Name)
+	}
+
+	if previous == nil {
+		if r.Entry.Sequence != 1 || r.Entry.Previous != "" {
+			return nil, fmt.Errorf("log starts at entry %d, earlier entries are missing", r.Entry.Sequence)
+		}
+	} else {
+		if r.Entry.Sequence == previous.Entry.Sequence+2 {
+			return nil, fmt.Errorf("entry %d is missing", previous.Entry.Sequence+1)
+		}
+		if r.Entry.Sequence != previous.Entry.Sequence+1 {
+			return nil, fmt.Errorf("entries %d to %d are missing", previous.Entry.Sequence+1, r.Entry.Sequence-1)
+		}
+		if r.Entry.Previous != previous.Hash {
+			return nil, fmt.Errorf("entry %d does not follow entry %d, it was changed", r.Entry.Sequence, previous.Entry.Sequence)
+		}
+	}
+
+	unsigned, err := r.Entry.signedBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	signature, err := checkDetached(ring, unsigned, r.Entry.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("entry %d: %v", r.Entry.Sequence, err)
+	}
+	if signature.Signer != nil && signature.Fingerprint() != NormalizeFingerprint(r.Entry.Signer) {
+		return nil, fmt.Errorf("entry %d claims signer %s, but is signed by %s", r.Entry.Sequence, r.Entry.Signer, signature.Identity())
+	}
+	return signature, nil
+}
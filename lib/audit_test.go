@@ -0,0 +1,123 @@
+package tresor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// auditChain seals entries into a log as AppendAuditEntry does
+func auditChain(t *testing.T, signer *openpgp.Entity, actions ...string) []*AuditRecord {
+	t.Helper()
+	var records []*AuditRecord
+	var head *auditHead
+	for _, action := range actions {
+		entry := &AuditEntry{Action: action, Key: "prod/db/pw", Generation: 1}
+		payload, err := entry.seal(signer, head, nil)
+		if err != nil {
+			t.Fatalf("seal() failed: %v", err)
+		}
+		record, err := parseAuditRecord(auditEntryName(entry.Sequence), payload)
+		if err != nil {
+			t.Fatalf("parseAuditRecord() failed: %v", err)
+		}
+		head = &auditHead{Sequence: entry.Sequence, Hash: record.Hash}
+		records = append(records, record)
+	}
+	return records
+}
+
+// restored parses a record again after changing its entry, as if it was changed in storage
+func restored(t *testing.T, record *AuditRecord, change func(entry *AuditEntry)) *AuditRecord {
+	t.Helper()
+	entry := *record.Entry
+	change(&entry)
+	payload, err := json.Marshal(&entry)
+	if err != nil {
+		t.Fatalf("failed to encode audit entry: %v", err)
+	}
+	changed, err := parseAuditRecord(record.Name, payload)
+	if err != nil {
+		t.Fatalf("parseAuditRecord() failed: %v", err)
+	}
+	return changed
+}
+
+func TestAuditRecordVerify(t *testing.T) {
+	alice := testEntity(t, "Alice", "alice@example.com")
+	bob := testEntity(t, "Bob", "bob@example.com")
+	ring := openpgp.EntityList{alice, bob}
+	records := auditChain(t, alice, "put", "cp", "rm", "put")
+
+	// An entry claiming Bob as signer, signed by Alice
+	impostor := restored(t, records[1], func(entry *AuditEntry) { entry.Signer = Fingerprint(bob) })
+	unsigned, err := impostor.Entry.signedBytes()
+	if err != nil {
+		t.Fatalf("signedBytes() failed: %v", err)
+	}
+	if impostor.Entry.Signature, err = signDetached(alice, unsigned, nil); err != nil {
+		t.Fatalf("signDetached() failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		record   *AuditRecord
+		previous *AuditRecord
+		ring     openpgp.EntityList
+		signer   *openpgp.Entity // Expected signer, nil for unknown keys
+		message  string          // Part of the expected error, empty if valid
+	}{
+		{"first", records[0], nil, ring, alice, ""},
+		{"chained", records[1], records[0], ring, alice, ""},
+		{"last", records[3], records[2], ring, alice, ""},
+		{"unknown signer", records[1], records[0], openpgp.EntityList{bob}, nil, ""},
+		{"first missing", records[1], nil, ring, nil, "log starts at entry 2"},
+		{"one missing", records[2], records[0], ring, nil, "entry 2 is missing"},
+		{"several missing", records[3], records[0], ring, nil, "entries 2 to 3 are missing"},
+		{"reordered", records[0], records[1], ring, nil, "missing"},
+		{"previous changed", records[2], restored(t, records[1], func(entry *AuditEntry) { entry.Action = "put" }), ring, nil, "entry 3 does not follow entry 2"},
+		{"entry changed", restored(t, records[1], func(entry *AuditEntry) { entry.Key = "prod/other" }), records[0], ring, nil, "signature is invalid"},
+		{"generation changed", restored(t, records[1], func(entry *AuditEntry) { entry.Generation = 2 }), records[0], ring, nil, "signature is invalid"},
+		{"signature removed", restored(t, records[1], func(entry *AuditEntry) { entry.Signature = "" }), records[0], ring, nil, "entry 2"},
+		{"stored elsewhere", &AuditRecord{Name: auditEntryName(5), Hash: records[1].Hash, Entry: records[1].Entry}, records[0], ring, nil, "entry 2 is stored as _log/0000000000000005"},
+		{"claimed signer", impostor, records[0], ring, nil, "claims signer"},
+	}
+	for _, test := range tests {
+		signature, err := test.record.Verify(test.ring, test.previous)
+		if test.message != "" {
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%s: Verify() error = %v, want %q", test.name, err, test.message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Verify() error = %v, want none", test.name, err)
+			continue
+		}
+		if signature.Signer != test.signer {
+			t.Errorf("%s: Verify() signer = %v, want %v", test.name, signature.Signer, test.signer)
+		}
+	}
+}
+
+func TestAuditEntrySeal(t *testing.T) {
+	alice := testEntity(t, "Alice", "alice@example.com")
+	records := auditChain(t, alice, "put", "put", "rm")
+
+	for i, record := range records {
+		if record.Entry.Sequence != int64(i+1) || record.Name != auditEntryName(int64(i+1)) {
+			t.Errorf("record %d is entry %d stored as %s", i, record.Entry.Sequence, record.Name)
+		}
+		if i > 0 && record.Entry.Previous != records[i-1].Hash {
+			t.Errorf("record %d refers to %s, want %s", i, record.Entry.Previous, records[i-1].Hash)
+		}
+		if record.Entry.Signer != Fingerprint(alice) {
+			t.Errorf("record %d signer = %s, want %s", i, record.Entry.Signer, Fingerprint(alice))
+		}
+	}
+	if records[0].Hash == records[1].Hash {
+		t.Errorf("equal entries have the same hash")
+	}
+}
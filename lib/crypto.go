@@ -1,16 +1,24 @@
 package tresor
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"syscall"
+	"path/filepath"
 
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/ssh/terminal"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	// SymmetricKeyID is passed to passphrase providers when asking for the passphrase of a symmetric object
+	SymmetricKeyID = "symmetric"
+
+	maxS2KCount = 65011712
 )
 
 // LoadArmoredKey loads an armored GPG keys from local disk
@@ -29,57 +37,153 @@ func LoadArmoredKey(location string) (key *openpgp.Entity, err error) {
 	return list[0], nil
 }
 
-// CallbackForPassword implements https://godoc.org/golang.org/x/crypto/openpgp#PromptFunction
+// LoadArmoredKeyRing loads all armored GPG keys contained in a local file
+func LoadArmoredKeyRing(location string) (ring openpgp.EntityList, err error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	defer file.Close()
+
+	ring, err = openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keyring %s: %v", location, err)
+	}
+
+	return ring, nil
+}
+
+// LoadKeyRingDirectory loads all armored GPG keys (*.asc) from a local directory
+func LoadKeyRingDirectory(location string) (ring openpgp.EntityList, err error) {
+	files, err := filepath.Glob(filepath.Join(location, "*.asc"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keyring directory: %v", err)
+	}
+
+	for _, file := range files {
+		keys, err := LoadArmoredKeyRing(file)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	if len(ring) == 0 {
+		return nil, fmt.Errorf("no keys found in keyring directory: %s", location)
+	}
+
+	return ring, nil
+}
+
+// CallbackForPassword implements https://pkg.go.dev/github.com/ProtonMail/go-crypto/openpgp#PromptFunction.
+// Keys are unlocked here even if a running agent holds them, since the agent could not decrypt the message.
 func CallbackForPassword(keys []openpgp.Key, symmetric bool) ([]byte, error) {
-	if symmetric {
-		return nil, fmt.Errorf("asked for symmetric key")
+	// Passphrase-only messages have no key candidates
+	if symmetric && len(keys) == 0 {
+		return GetUserPassword(SymmetricKeyID)
 	}
 
-	if len(keys) != 1 {
-		return nil, fmt.Errorf("too many keys received")
+	// Only keys matching the recipients of the message are passed in, so
+	// there is no need to prompt for any other key in the ring
+	err := fmt.Errorf("no private key matching the message")
+	for _, key := range keys {
+		if key.PrivateKey == nil {
+			continue
+		}
+
+		// The passphrase is only returned for symmetric keys, so unlocking suffices
+		if _, err = unlockKey(key.PrivateKey); err == nil {
+			return nil, nil
+		}
 	}
 
-	if keys[0].PrivateKey == nil {
-		return nil, fmt.Errorf("no private key detected")
+	return nil, err
+}
+
+// UnlockPrivateKey decrypts a private key with the configured passphrase provider. Keys held by a
+// running agent are left locked, the agent decrypts and signs with them instead.
+func UnlockPrivateKey(key *packet.PrivateKey) error {
+	if key.Encrypted && agentHolds(key.KeyIdString()) {
+		return nil
 	}
+	_, err := unlockKey(key)
+	return err
+}
 
-	passwordBytes, err := GetUserPassword(keys[0].PrivateKey.KeyIdString())
-	if err != nil {
-		return nil, err
+// unlockKey decrypts a private key, hands it to a running agent and returns the passphrase that unlocked it
+func unlockKey(key *packet.PrivateKey) ([]byte, error) {
+	if !key.Encrypted {
+		return nil, nil
 	}
+	keyID := key.KeyIdString()
 
-	keys[0].PrivateKey.Decrypt(passwordBytes)
+	for attempt := 1; attempt <= passphraseRetries; attempt++ {
+		passwordBytes, err := GetUserPassword(keyID)
+		if err != nil {
+			return nil, err
+		}
+		if err = key.Decrypt(passwordBytes); err == nil {
+			agentStore(key)
+			return passwordBytes, nil
+		}
+		if attempt < passphraseRetries {
+			fmt.Fprintf(os.Stderr, "Bad passphrase for key %s, %d attempt(s) left.\n", keyID, passphraseRetries-attempt)
+		}
+	}
 
-	return passwordBytes, nil
+	return nil, fmt.Errorf("failed to unlock private key %s: %w", keyID, ErrBadPassphrase)
 }
 
-// GetUserPassword promtps for a user password to decrypt private keys
+// GetUserPassword obtains a user password to decrypt private keys from the configured provider
 func GetUserPassword(keyID string) ([]byte, error) {
-	fmt.Fprintf(os.Stderr, "Enter Password for key %s: ", keyID)
-	passwordBytes, err := terminal.ReadPassword(int(syscall.Stdin))
-	fmt.Fprintln(os.Stderr, "")
+	return passphraseProvider(keyID)
+}
+
+// EncryptBytes encrypts a byte sequence to all recipients and signs it using the given algorithm settings
+func EncryptBytes(recipients openpgp.EntityList, signer *openpgp.Entity, plainBytes []byte, armored bool, settings *CryptoSettings) (encryptedBytes []byte, err error) {
+	if settings == nil {
+		settings = DefaultCryptoSettings()
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt to")
+	}
+	for _, recipient := range recipients {
+		if err = CheckRecipient(recipient); err != nil {
+			return nil, err
+		}
+		if err = settings.Check(recipient, signer != nil); err != nil {
+			return nil, err
+		}
+	}
+	if signer != nil {
+		if err = CheckSigner(signer); err != nil {
+			return nil, err
+		}
+	}
+	if key := lockedSigningKey(signer); key != nil {
+		if encryptedBytes, err = agentEncryptBytes(recipients, signer, plainBytes, armored, settings); err == nil {
+			return encryptedBytes, nil
+		}
+		// The agent may have dropped the key since, so it is unlocked here instead
+		if _, err = unlockKey(key); err != nil {
+			return nil, err
+		}
+	}
+	config, err := settings.PacketConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user password: %v", err)
+		return nil, err
 	}
 
-	return passwordBytes, nil
-}
-
-// EncryptBytes encrypts and signs a byte sequence
-func EncryptBytes(recipient *openpgp.Entity, signer *openpgp.Entity, plainBytes []byte, armored bool) (encryptedBytes []byte, err error) {
 	if armored {
-		return encryptArmored(recipient, signer, plainBytes)
+		return encryptArmored(recipients, signer, plainBytes, config)
 	}
-	return encryptBinary(recipient, signer, plainBytes)
+	return encryptBinary(recipients, signer, plainBytes, config)
 }
 
-func encryptBinary(recipient *openpgp.Entity, signer *openpgp.Entity, plainBytes []byte) ([]byte, error) {
-	recipients := make([]*openpgp.Entity, 1)
-	recipients[0] = recipient
-
+func encryptBinary(recipients openpgp.EntityList, signer *openpgp.Entity, plainBytes []byte, config *packet.Config) ([]byte, error) {
 	cryptoBuffer := bytes.NewBuffer(nil)
 
-	cryptoWriter, err := openpgp.Encrypt(cryptoBuffer, recipients, signer, nil, nil)
+	cryptoWriter, err := openpgp.Encrypt(cryptoBuffer, recipients, signer, nil, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open stream writer: %v", err)
 	}
@@ -92,17 +196,14 @@ func encryptBinary(recipient *openpgp.Entity, signer *openpgp.Entity, plainBytes
 	return cryptoBuffer.Bytes(), nil
 }
 
-func encryptArmored(recipient *openpgp.Entity, signer *openpgp.Entity, plainBytes []byte) ([]byte, error) {
-	recipients := make([]*openpgp.Entity, 1)
-	recipients[0] = recipient
-
+func encryptArmored(recipients openpgp.EntityList, signer *openpgp.Entity, plainBytes []byte, config *packet.Config) ([]byte, error) {
 	cryptoBuffer := bytes.NewBuffer(nil)
 
-	armorWriter, err := armor.Encode(cryptoBuffer, "Message", nil)
+	armorWriter, err := armor.Encode(cryptoBuffer, openpgp.MessageType, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open armor writer: %v", err)
 	}
-	cryptoWriter, err := openpgp.Encrypt(armorWriter, recipients, signer, nil, nil)
+	cryptoWriter, err := openpgp.Encrypt(armorWriter, recipients, signer, nil, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open stream writer: %v", err)
 	}
@@ -118,36 +219,245 @@ func encryptArmored(recipient *openpgp.Entity, signer *openpgp.Entity, plainByte
 	return cryptoBuffer.Bytes(), nil
 }
 
-// DecryptBytes decrypts and verifies a byte sequence
-func DecryptBytes(ring openpgp.EntityList, payload []byte) (plain []byte, err error) {
-	// Attempt to find and decode ASCII armor
-	var message *openpgp.MessageDetails
+// EncryptSymmetric encrypts a byte sequence with a key derived from a passphrase
+func EncryptSymmetric(passphrase []byte, plainBytes []byte, armored bool, settings *CryptoSettings) (encryptedBytes []byte, err error) {
+	if settings == nil {
+		settings = DefaultCryptoSettings()
+	}
+	config, err := settings.PacketConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Use the strongest iterated S2K unless configured otherwise
+	if config.S2KConfig.S2KCount == 0 {
+		config.S2KConfig.S2KCount = maxS2KCount
+	}
+
+	cryptoBuffer := bytes.NewBuffer(nil)
+
+	var output io.WriteCloser = nopWriteCloser{cryptoBuffer}
+	if armored {
+		if output, err = armor.Encode(cryptoBuffer, openpgp.MessageType, nil); err != nil {
+			return nil, fmt.Errorf("failed to open armor writer: %v", err)
+		}
+	}
 
-	armoredBlock, err := armor.Decode(bytes.NewReader(payload))
-	if err != nil && err != io.EOF {
+	cryptoWriter, err := openpgp.SymmetricallyEncrypt(output, passphrase, nil, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream writer: %v", err)
+	}
+	if _, err = cryptoWriter.Write(plainBytes); err != nil {
+		return nil, fmt.Errorf("failed to write stream: %v", err)
+	}
+	if err = cryptoWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close stream: %v", err)
+	}
+	if err = output.Close(); err != nil {
+		return nil, fmt.Errorf("failed to armor stream: %v", err)
+	}
+	return cryptoBuffer.Bytes(), nil
+}
+
+// DecryptBytes decrypts a byte sequence and verifies its signature against a policy
+func DecryptBytes(ring openpgp.EntityList, payload []byte, policy *SignaturePolicy) (plain []byte, signature *Signature, err error) {
+	plainBuffer := bytes.NewBuffer(nil)
+
+	report, err := decryptStream(ring, bytes.NewReader(payload), policy, plainBuffer)
+	if err != nil {
+		if report != nil && report.Signature != nil {
+			return nil, report.Signature, err
+		}
+		return nil, nil, err
+	}
+
+	return plainBuffer.Bytes(), report.Signature, nil
+}
+
+// VerifyStream decrypts a message and verifies its signature against a policy, discarding the plaintext
+func VerifyStream(ring openpgp.EntityList, reader io.Reader, policy *SignaturePolicy) (report *Report, err error) {
+	return decryptStream(ring, reader, policy, ioutil.Discard)
+}
+
+// limitSymmetricAttempts stops asking for the passphrase of a symmetric message, which
+// would otherwise be requested again forever
+func limitSymmetricAttempts(prompt openpgp.PromptFunction) openpgp.PromptFunction {
+	attempts := 0
+	return func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if symmetric && len(keys) == 0 {
+			if attempts == passphraseRetries {
+				return nil, fmt.Errorf("failed to decrypt symmetric message: %w", ErrBadPassphrase)
+			}
+			if attempts > 0 {
+				fmt.Fprintf(os.Stderr, "Bad passphrase, %d attempt(s) left.\n", passphraseRetries-attempts)
+			}
+			attempts++
+		}
+		return prompt(keys, symmetric)
+	}
+}
+
+// openPGPBody returns the packets of an OpenPGP message, which is binary or ASCII armored. Binary
+// packets always have the high bit set, anything else has to be ASCII armor.
+func openPGPBody(buffered *bufio.Reader) (body io.Reader, armored bool, err error) {
+	first, err := buffered.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	if first[0]&0x80 != 0 {
+		return buffered, false, nil
+	}
+	block, err := armor.Decode(buffered)
+	if err != nil {
+		return nil, false, err
+	}
+	return block.Body, true, nil
+}
+
+func decryptStream(ring openpgp.EntityList, reader io.Reader, policy *SignaturePolicy, plain io.Writer) (*Report, error) {
+	report := &Report{}
+	body, armored, err := openPGPBody(bufio.NewReader(reader))
+	if err != nil {
 		return nil, fmt.Errorf("failed to decode object: %v", err)
 	}
+	report.Armored = armored
 
-	if armoredBlock != nil {
-		message, err = openpgp.ReadMessage(armoredBlock.Body, ring, CallbackForPassword, nil)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read armored gpg message: %v", err)
+	// A running agent decrypts with the keys it holds, which stay locked here. Otherwise the
+	// packets read so far are read again.
+	if agentSocket != "" {
+		leading := &leadingPackets{}
+		if decrypted := agentDecryptStream(ring, io.TeeReader(body, leading), report); decrypted != nil {
+			leading.done = true
+			report.Integrity = integrityProtection(leading.Bytes())
+			return readDecrypted(ring, decrypted, policy, plain, report)
 		}
-	} else {
-		message, err = openpgp.ReadMessage(bytes.NewReader(payload), ring, CallbackForPassword, nil)
+		body = io.MultiReader(bytes.NewReader(leading.Bytes()), body)
+	}
+
+	// Keep the leading packets to inspect them after decryption
+	header := &headerBuffer{limit: headerLimit}
+	message, err := openpgp.ReadMessage(io.TeeReader(body, header), ring, limitSymmetricAttempts(CallbackForPassword), nil)
+	report.Integrity = integrityProtection(header.Bytes())
+	if err != nil {
+		return report, fmt.Errorf("failed to read gpg message: %w", err)
+	}
+
+	report.Recipients = message.EncryptedToKeyIds
+	report.Symmetric = message.IsSymmetricallyEncrypted
+	if message.DecryptedWith.PublicKey != nil {
+		report.DecryptedWith = message.DecryptedWith.PublicKey.KeyId
+	}
+
+	// Integrity checks fail at the end of the stream
+	if report.Size, err = io.Copy(plain, message.UnverifiedBody); err != nil {
+		return report, fmt.Errorf("failed to read gpg data: %v", err)
+	}
+	return checkMessageSignature(message, policy, report)
+}
+
+// leadingPackets records the packets in front of the encrypted data until it is decrypted
+type leadingPackets struct {
+	bytes.Buffer
+	done bool
+}
+
+func (l *leadingPackets) Write(p []byte) (int, error) {
+	if !l.done {
+		l.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+// agentDecryptStream reads the packets in front of the encrypted data and has the agent decrypt
+// the session key. It returns nil if the message has to be decrypted without the agent.
+func agentDecryptStream(ring openpgp.EntityList, reader io.Reader, report *Report) io.ReadCloser {
+	packets := packet.NewReader(reader)
+	var encryptedKeys []*packet.EncryptedKey
+	var data packet.EncryptedDataPacket
+	symmetric := false
+	for data == nil {
+		p, err := packets.Next()
 		if err != nil {
-			return nil, fmt.Errorf("failed to read gpg message: %v", err)
+			return nil
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			encryptedKeys = append(encryptedKeys, p)
+		case *packet.SymmetricKeyEncrypted:
+			symmetric = true
+		case *packet.SymmetricallyEncrypted:
+			// Messages without integrity protection are refused when read again
+			if !p.IntegrityProtected {
+				return nil
+			}
+			data = p
+		case *packet.AEADEncrypted:
+			data = p
+		default:
+			return nil
+		}
+	}
+
+	for _, encryptedKey := range encryptedKeys {
+		for _, key := range ring.KeysById(encryptedKey.KeyId) {
+			if key.PrivateKey == nil {
+				continue
+			}
+			// Unlocked keys decrypt the message without the agent
+			if !key.PrivateKey.Encrypted {
+				return nil
+			}
+			cipher, sessionKey, err := agentSessionKey(encryptedKey)
+			if err != nil {
+				continue
+			}
+			decrypted, err := data.Decrypt(cipher, sessionKey)
+			if err != nil {
+				return nil
+			}
+
+			for _, encryptedKey := range encryptedKeys {
+				report.Recipients = append(report.Recipients, encryptedKey.KeyId)
+			}
+			report.Symmetric = symmetric
+			report.DecryptedWith = key.PublicKey.KeyId
+			return decrypted
 		}
 	}
+	return nil
+}
 
-	bytes, err := ioutil.ReadAll(message.UnverifiedBody)
+// readDecrypted reads the packets inside encrypted data decrypted with a session key
+func readDecrypted(ring openpgp.EntityList, decrypted io.ReadCloser, policy *SignaturePolicy, plain io.Writer, report *Report) (*Report, error) {
+	message, err := openpgp.ReadMessage(decrypted, ring, nil, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read gpg data: %v", err)
+		return report, fmt.Errorf("failed to read gpg message: %w", err)
 	}
+	if report.Size, err = io.Copy(plain, message.UnverifiedBody); err != nil {
+		return report, fmt.Errorf("failed to read gpg data: %v", err)
+	}
+	// The integrity of the encrypted data is checked once it is closed
+	if err = decrypted.Close(); err != nil {
+		return report, fmt.Errorf("failed to read gpg data: %v", err)
+	}
+	return checkMessageSignature(message, policy, report)
+}
 
+// checkMessageSignature verifies the signature of a message read to its end against a policy
+func checkMessageSignature(message *openpgp.MessageDetails, policy *SignaturePolicy, report *Report) (*Report, error) {
 	if message.SignatureError != nil {
-		return nil, message.SignatureError
+		return report, message.SignatureError
+	}
+
+	report.Signature = &Signature{Signed: message.IsSigned, KeyID: message.SignedByKeyId}
+	if message.SignedBy != nil {
+		report.Signature.Signer = message.SignedBy.Entity
+	}
+
+	if policy != nil {
+		if err := policy.Verify(report.Signature); err != nil {
+			return report, fmt.Errorf("failed to verify signature: %v", err)
+		}
 	}
 
-	return bytes, nil
+	return report, nil
 }
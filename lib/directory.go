@@ -0,0 +1,126 @@
+package tresor
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// KeyDirectory is the prefix under which vault members publish their public keys
+const KeyDirectory = "_keys/"
+
+// DirectoryKey is a public key published in the key directory of a vault
+type DirectoryKey struct {
+	Name   string // Object name
+	Entity *openpgp.Entity
+}
+
+// PublishKey uploads a self-signed public key to the key directory of a vault
+func PublishKey(bucketName string, entity *openpgp.Entity) (key string, err error) {
+	if selfSignature, _ := entity.PrimarySelfSignature(); selfSignature == nil {
+		return "", fmt.Errorf("key %s has no valid self-signature", Fingerprint(entity))
+	}
+	if status := CheckKey(entity, time.Now()); status.Revoked || status.Expired || !status.Encrypt {
+		return "", fmt.Errorf("refusing to publish key %s, it is %s", Fingerprint(entity), status)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	output, err := armor.Encode(buffer, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open armor writer: %v", err)
+	}
+	if err = entity.Serialize(output); err != nil {
+		return "", fmt.Errorf("failed to serialize key: %v", err)
+	}
+	if err = output.Close(); err != nil {
+		return "", fmt.Errorf("failed to armor key: %v", err)
+	}
+
+	key = KeyDirectory + Fingerprint(entity) + ".asc"
+	if err = WriteObject(bucketName, key, buffer.Bytes()); err != nil {
+		return "", err
+	}
+
+	meta := storage.ObjectAttrsToUpdate{
+		ContentType: "application/pgp-keys",
+		Metadata: map[string]string{
+			"Fingerprint": Fingerprint(entity),
+			"Identity":    PrimaryIdentity(entity),
+		},
+	}
+	return key, WriteMetadata(bucketName, key, meta)
+}
+
+// FindKeys looks up the published keys with a user ID for an email address, or with a fingerprint.
+// Self-signatures are verified while parsing, so identities without one are never matched.
+func FindKeys(bucketName string, query string) ([]*DirectoryKey, error) {
+	fingerprint := NormalizeFingerprint(query)
+	byFingerprint := !strings.Contains(query, "@")
+
+	keys, err := PublishedKeys(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*DirectoryKey
+	for _, key := range keys {
+		if byFingerprint && Fingerprint(key.Entity) != fingerprint {
+			continue
+		}
+		if !byFingerprint && !hasEmail(key.Entity, query) {
+			continue
+		}
+		found = append(found, key)
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no key published for %s", query)
+	}
+	return found, nil
+}
+
+// PublishedKeys loads all keys published in the key directory of a vault
+func PublishedKeys(bucketName string) ([]*DirectoryKey, error) {
+	attrs, err := QueryStorage(bucketName, KeyDirectory, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*DirectoryKey
+	for _, attr := range attrs {
+		name := strings.TrimPrefix(attr.Name, KeyDirectory)
+		if !strings.HasSuffix(name, ".asc") {
+			continue
+		}
+
+		content, err := ReadObject(bucketName, attr.Name, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read published key %s: %v", attr.Name, err)
+		}
+		ring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load published key %s: %v", attr.Name, err)
+		}
+
+		// Keys are published under their own fingerprint only
+		if len(ring) != 1 || Fingerprint(ring[0])+".asc" != name {
+			return nil, fmt.Errorf("published key %s does not match its name", attr.Name)
+		}
+		keys = append(keys, &DirectoryKey{Name: attr.Name, Entity: ring[0]})
+	}
+	return keys, nil
+}
+
+func hasEmail(entity *openpgp.Entity, email string) bool {
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, email) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package tresor
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes a local file through a temporary file in the same directory, which
+// replaces the file once it is completely written and synced. Readers and crashes never leave
+// a partially written file behind.
+func writeFileAtomic(location string, mode os.FileMode, write func(io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(location), "."+filepath.Base(location))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err = file.Chmod(mode); err != nil {
+		return err
+	}
+	if err = write(file); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), location)
+}
@@ -0,0 +1,79 @@
+package tresor
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	// FormatOpenPGP encrypts objects as OpenPGP messages
+	FormatOpenPGP = "openpgp"
+	// FormatAge encrypts objects as age files
+	FormatAge = "age"
+)
+
+// Crypto encrypts and decrypts objects in one particular format
+type Crypto interface {
+	// Format names the format, as recorded in object metadata
+	Format() string
+	// Encrypt encrypts (and signs, if supported) a byte sequence
+	Encrypt(plainBytes []byte) (encryptedBytes []byte, err error)
+	// Decrypt decrypts a byte sequence and verifies its signature, if any
+	Decrypt(payload []byte) (plainBytes []byte, signature *Signature, err error)
+	// Verify decrypts and verifies a stream, writing the plaintext to plain
+	Verify(reader io.Reader, plain io.Writer) (report *Report, err error)
+}
+
+// OpenPGPCrypto implements Crypto using OpenPGP messages
+type OpenPGPCrypto struct {
+	Recipients openpgp.EntityList
+	Signer     *openpgp.Entity
+	Passphrase []byte // Encrypt with a passphrase instead of the recipient
+	Armored    bool
+	Settings   *CryptoSettings
+	Ring       openpgp.EntityList
+	Policy     *SignaturePolicy
+}
+
+// Format implements Crypto
+func (c *OpenPGPCrypto) Format() string {
+	return FormatOpenPGP
+}
+
+// Encrypt implements Crypto
+func (c *OpenPGPCrypto) Encrypt(plainBytes []byte) ([]byte, error) {
+	if c.Passphrase != nil {
+		return EncryptSymmetric(c.Passphrase, plainBytes, c.Armored, c.Settings)
+	}
+	return EncryptBytes(c.Recipients, c.Signer, plainBytes, c.Armored, c.Settings)
+}
+
+// Decrypt implements Crypto
+func (c *OpenPGPCrypto) Decrypt(payload []byte) ([]byte, *Signature, error) {
+	return DecryptBytes(c.Ring, payload, c.Policy)
+}
+
+// Verify implements Crypto
+func (c *OpenPGPCrypto) Verify(reader io.Reader, plain io.Writer) (*Report, error) {
+	return decryptStream(c.Ring, reader, c.Policy, plain)
+}
+
+// ObjectFormat returns the format recorded in object metadata. Objects written
+// before formats were recorded are OpenPGP messages.
+func ObjectFormat(metadata map[string]string) string {
+	if format, ok := metadata["Format"]; ok && format != emptyMetadata {
+		return format
+	}
+	return FormatOpenPGP
+}
+
+// CheckFormat makes sure a format is supported
+func CheckFormat(format string) error {
+	switch format {
+	case FormatOpenPGP, FormatAge:
+		return nil
+	}
+	return fmt.Errorf("unsupported format: %s", format)
+}
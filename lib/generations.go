@@ -0,0 +1,119 @@
+package tresor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// RollbackError is returned if an object is older than the version seen before
+type RollbackError struct {
+	Vault      string
+	Key        string
+	Seen       int64 // Generation seen before
+	Generation int64 // Generation presented now
+	Replaces   int64 // Generation the presented object was written to replace
+	Deleted    int64 // Generation removed before, 0 if no removal was seen
+}
+
+func (e *RollbackError) Error() string {
+	if e.Generation < e.Seen {
+		return fmt.Sprintf("%s in vault %s was rolled back from generation %d to %d", e.Key, e.Vault, e.Seen, e.Generation)
+	}
+	if e.Deleted >= e.Seen {
+		return fmt.Sprintf("%s in vault %s was removed at generation %d and stored again at generation %d, but neither the vault state nor the audit log record it. An older version may have been restored.",
+			e.Key, e.Vault, e.Deleted, e.Generation)
+	}
+	return fmt.Sprintf("%s in vault %s at generation %d replaces generation %d, but generation %d was seen before. An older version may have been stored again.",
+		e.Key, e.Vault, e.Generation, e.Replaces, e.Seen)
+}
+
+// GenerationLog remembers the latest generation seen for every object, per vault, and the
+// generations removed since
+type GenerationLog struct {
+	location string
+	Vaults   map[string]map[string]int64 `json:"vaults"`
+	Deleted  map[string]map[string]int64 `json:"deleted,omitempty"`
+}
+
+// LoadGenerationLog loads seen generations from local disk. A missing file holds no generations.
+func LoadGenerationLog(location string) (*GenerationLog, error) {
+	log := &GenerationLog{location: location, Vaults: map[string]map[string]int64{}, Deleted: map[string]map[string]int64{}}
+
+	content, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return log, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generation log: %v", err)
+	}
+	if err = json.Unmarshal(content, log); err != nil {
+		return nil, fmt.Errorf("failed to parse generation log %s: %v", location, err)
+	}
+	if log.Vaults == nil {
+		log.Vaults = map[string]map[string]int64{}
+	}
+	if log.Deleted == nil {
+		log.Deleted = map[string]map[string]int64{}
+	}
+	return log, nil
+}
+
+// Check compares an object against the generation seen before. Objects written by tresor record
+// the generation they replace in their header, so replaying an older object as a new generation
+// is detected as well. Objects without header only have their generation checked. Objects stored
+// again after being removed replace no generation, so they are reported as well and have to be
+// accepted with a signed record of the removal.
+func (l *GenerationLog) Check(vault string, key string, generation int64, header *ObjectHeader) error {
+	seen, ok := l.Vaults[vault][key]
+	if !ok || generation == seen {
+		return nil
+	}
+	if generation < seen {
+		return &RollbackError{Vault: vault, Key: key, Seen: seen, Generation: generation}
+	}
+	if header != nil && header.Replaces < seen {
+		return &RollbackError{Vault: vault, Key: key, Seen: seen, Generation: generation, Replaces: header.Replaces, Deleted: l.Deleted[vault][key]}
+	}
+	return nil
+}
+
+// Record remembers a generation of an object, if it is newer than the one seen before
+func (l *GenerationLog) Record(vault string, key string, generation int64) {
+	if l.Vaults[vault] == nil {
+		l.Vaults[vault] = map[string]int64{}
+	}
+	if generation > l.Vaults[vault][key] {
+		l.Vaults[vault][key] = generation
+	}
+	if generation > l.Deleted[vault][key] {
+		delete(l.Deleted[vault], key)
+	}
+}
+
+// RecordDeletion remembers the generation of an object that was removed
+func (l *GenerationLog) RecordDeletion(vault string, key string, generation int64) {
+	if l.Deleted[vault] == nil {
+		l.Deleted[vault] = map[string]int64{}
+	}
+	l.Deleted[vault][key] = generation
+}
+
+// Save writes the log to local disk, only readable by the owner
+func (l *GenerationLog) Save() error {
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode generation log: %v", err)
+	}
+
+	err = writeFileAtomic(l.location, 0600, func(writer io.Writer) error {
+		_, err := writer.Write(content)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write generation log: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package tresor
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerationLogCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		seen       int64 // Generation seen before, 0 if none
+		deleted    int64 // Generation removed before, 0 if none
+		generation int64
+		header     *ObjectHeader
+		message    string // Part of the expected RollbackError, empty if accepted
+	}{
+		{"never seen", 0, 0, 5, &ObjectHeader{Replaces: 0}, ""},
+		{"same generation", 5, 0, 5, &ObjectHeader{Replaces: 4}, ""},
+		{"newer replaces seen", 5, 0, 7, &ObjectHeader{Replaces: 5}, ""},
+		{"newer replaces newer than seen", 5, 0, 9, &ObjectHeader{Replaces: 7}, ""},
+		{"newer without header", 5, 0, 7, nil, ""},
+		{"older", 5, 0, 3, &ObjectHeader{Replaces: 2}, "rolled back from generation 5 to 3"},
+		{"older without header", 5, 0, 3, nil, "rolled back from generation 5 to 3"},
+		{"replayed", 5, 0, 7, &ObjectHeader{Replaces: 3}, "replaces generation 3, but generation 5 was seen before"},
+		{"stored again after removal", 5, 5, 7, &ObjectHeader{Replaces: 0}, "was removed at generation 5 and stored again at generation 7"},
+		{"replayed after older removal", 5, 3, 7, &ObjectHeader{Replaces: 0}, "replaces generation 0, but generation 5 was seen before"},
+		{"older after removal", 5, 5, 3, &ObjectHeader{Replaces: 0}, "rolled back from generation 5 to 3"},
+	}
+	for _, test := range tests {
+		log, err := LoadGenerationLog(filepath.Join(t.TempDir(), "generations.json"))
+		if err != nil {
+			t.Fatalf("LoadGenerationLog() failed: %v", err)
+		}
+		if test.seen != 0 {
+			log.Record("vault", "key", test.seen)
+		}
+		if test.deleted != 0 {
+			log.RecordDeletion("vault", "key", test.deleted)
+		}
+
+		err = log.Check("vault", "key", test.generation, test.header)
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("%s: Check() error = %v, want none", test.name, err)
+			}
+			continue
+		}
+		var rollback *RollbackError
+		if !errors.As(err, &rollback) || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: Check() error = %v, want rollback %q", test.name, err, test.message)
+		}
+		if err = log.Check("other", "key", test.generation, test.header); err != nil {
+			t.Errorf("%s: Check() in other vault error = %v, want none", test.name, err)
+		}
+	}
+}
+
+func TestGenerationLogRecord(t *testing.T) {
+	// The steps run in order against the same log
+	tests := []struct {
+		name       string
+		generation int64
+		deletion   bool
+		seen       int64
+		deleted    int64
+	}{
+		{"first", 5, false, 5, 0},
+		{"newer", 7, false, 7, 0},
+		{"older is ignored", 3, false, 7, 0},
+		{"removed", 7, true, 7, 7},
+		{"removal survives older", 6, false, 7, 7},
+		{"stored again", 9, false, 9, 0},
+	}
+
+	log, err := LoadGenerationLog(filepath.Join(t.TempDir(), "generations.json"))
+	if err != nil {
+		t.Fatalf("LoadGenerationLog() failed: %v", err)
+	}
+	for _, test := range tests {
+		if test.deletion {
+			log.RecordDeletion("vault", "key", test.generation)
+		} else {
+			log.Record("vault", "key", test.generation)
+		}
+		if seen, deleted := log.Vaults["vault"]["key"], log.Deleted["vault"]["key"]; seen != test.seen || deleted != test.deleted {
+			t.Errorf("%s: seen %d, deleted %d, want %d, %d", test.name, seen, deleted, test.seen, test.deleted)
+		}
+	}
+
+	// The log survives saving and loading
+	log.RecordDeletion("vault", "other", 3)
+	if err = log.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	loaded, err := LoadGenerationLog(log.location)
+	if err != nil {
+		t.Fatalf("LoadGenerationLog() failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Vaults, log.Vaults) || !reflect.DeepEqual(loaded.Deleted, log.Deleted) {
+		t.Errorf("loaded log %v, %v, want %v, %v", loaded.Vaults, loaded.Deleted, log.Vaults, log.Deleted)
+	}
+}
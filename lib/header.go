@@ -0,0 +1,203 @@
+package tresor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	objectHeaderMagic = "tresor-header-v1\n"
+	objectHeaderLimit = 64 * 1024
+)
+
+// ObjectHeader describes the original file of an object. It is stored in front of the plaintext,
+// so it is encrypted and covered by the integrity protection and signature of the object.
+type ObjectHeader struct {
+	Name        string      `json:"name,omitempty"`     // Object key the object was stored under
+	Replaces    int64       `json:"replaces,omitempty"` // Generation of the object replaced when storing
+	Filename    string      `json:"filename,omitempty"`
+	Extension   string      `json:"extension,omitempty"`
+	ContentType string      `json:"content_type"`
+	Mode        os.FileMode `json:"mode,omitempty"`
+	ModTime     time.Time   `json:"mtime"`
+	Size        int64       `json:"size"`
+	SHA256      string      `json:"sha256"`
+}
+
+// NewObjectHeader describes the content of an object, read from a local file if location is set
+func NewObjectHeader(location string, content []byte) (*ObjectHeader, error) {
+	digest := sha256.Sum256(content)
+	header := &ObjectHeader{
+		ContentType: http.DetectContentType(content),
+		Size:        int64(len(content)),
+		SHA256:      hex.EncodeToString(digest[:]),
+	}
+	if location == "" {
+		return header, nil
+	}
+
+	info, err := os.Stat(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file info: %v", err)
+	}
+	header.Filename = filepath.Base(location)
+	header.Extension = filepath.Ext(location)
+	header.Mode = info.Mode().Perm()
+	header.ModTime = info.ModTime().UTC()
+	if contentType := mime.TypeByExtension(header.Extension); contentType != "" {
+		header.ContentType = contentType
+	}
+	return header, nil
+}
+
+// WrapHeader prepends the header to the content of an object before encryption
+func WrapHeader(header *ObjectHeader, content []byte) ([]byte, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode object header: %v", err)
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(objectHeaderMagic)+len(encoded)+1+len(content)))
+	buffer.WriteString(objectHeaderMagic)
+	buffer.Write(encoded)
+	buffer.WriteByte('\n')
+	buffer.Write(content)
+	return buffer.Bytes(), nil
+}
+
+// UnwrapHeader splits decrypted plaintext into header and content, strips any padding and checks
+// the content against the header. Objects stored without header are returned as they are, with a
+// nil header.
+func UnwrapHeader(plainBytes []byte) (*ObjectHeader, []byte, error) {
+	checker := &HeaderChecker{}
+	checker.Write(plainBytes)
+	header, err := checker.Header()
+	if err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		return nil, plainBytes, nil
+	}
+	return header, plainBytes[checker.start : checker.start+header.Size], nil
+}
+
+// HeaderChecker checks plaintext written to it against its header, like UnwrapHeader, without
+// keeping the content. Write never fails, so decryption always reads the whole stream, and the
+// result is returned by Header.
+type HeaderChecker struct {
+	prefix   []byte // Plaintext up to the end of the header
+	header   *ObjectHeader
+	noHeader bool
+	start    int64 // Offset of the content
+	content  int64 // Content bytes written
+	digest   hash.Hash
+	err      error
+}
+
+// Write implements io.Writer
+func (c *HeaderChecker) Write(p []byte) (int, error) {
+	if c.err != nil || c.noHeader {
+		return len(p), nil
+	}
+	if c.header == nil {
+		rest, err := c.readHeader(p)
+		if err != nil {
+			c.err = err
+		}
+		if c.header == nil {
+			return len(p), nil
+		}
+		c.writeContent(rest)
+		return len(p), nil
+	}
+	c.writeContent(p)
+	return len(p), nil
+}
+
+// readHeader buffers plaintext until the header is complete and returns the content following it
+func (c *HeaderChecker) readHeader(p []byte) ([]byte, error) {
+	c.prefix = append(c.prefix, p...)
+	magic := []byte(objectHeaderMagic)
+	if len(c.prefix) < len(magic) {
+		if !bytes.HasPrefix(magic, c.prefix) {
+			c.noHeader = true
+		}
+		return nil, nil
+	}
+	if !bytes.HasPrefix(c.prefix, magic) {
+		c.noHeader = true
+		return nil, nil
+	}
+
+	rest := c.prefix[len(magic):]
+	end := bytes.IndexByte(rest, '\n')
+	if end > objectHeaderLimit || (end < 0 && len(rest) > objectHeaderLimit) {
+		return nil, fmt.Errorf("failed to read object header: not terminated")
+	}
+	if end < 0 {
+		return nil, nil
+	}
+
+	header := &ObjectHeader{}
+	if err := json.Unmarshal(rest[:end], header); err != nil {
+		return nil, fmt.Errorf("failed to read object header: %v", err)
+	}
+	if header.Size < 0 {
+		return nil, fmt.Errorf("failed to read object header: negative size")
+	}
+	c.header = header
+	c.start = int64(len(magic) + end + 1)
+	c.digest = sha256.New()
+	content := rest[end+1:]
+	c.prefix = nil
+	return content, nil
+}
+
+// writeContent hashes the content and makes sure the padding after it is all zeros
+func (c *HeaderChecker) writeContent(p []byte) {
+	if remaining := c.header.Size - c.content; remaining > 0 {
+		n := int64(len(p))
+		if n > remaining {
+			n = remaining
+		}
+		c.digest.Write(p[:n])
+		c.content += n
+		p = p[n:]
+	}
+	for _, b := range p {
+		if b != 0 {
+			c.err = fmt.Errorf("object content is longer than its header says")
+			return
+		}
+	}
+}
+
+// Header returns the header after all plaintext was written, or nil if the object has none. It
+// fails if the plaintext does not match the header.
+func (c *HeaderChecker) Header() (*ObjectHeader, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.header == nil {
+		if !c.noHeader && len(c.prefix) >= len(objectHeaderMagic) {
+			return nil, fmt.Errorf("failed to read object header: not terminated")
+		}
+		return nil, nil
+	}
+	if c.content < c.header.Size {
+		return nil, fmt.Errorf("object content is %d bytes, header says %d", c.content, c.header.Size)
+	}
+	if hex.EncodeToString(c.digest.Sum(nil)) != c.header.SHA256 {
+		return nil, fmt.Errorf("object content does not match SHA-256 in header")
+	}
+	return c.header, nil
+}
@@ -0,0 +1,103 @@
+package tresor
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func wrappedObject(t *testing.T, content string) ([]byte, *ObjectHeader) {
+	t.Helper()
+	header, err := NewObjectHeader("", []byte(content))
+	if err != nil {
+		t.Fatalf("NewObjectHeader() failed: %v", err)
+	}
+	header.Name = "prod/db/pw"
+	header.Replaces = 42
+	plainBytes, err := WrapHeader(header, []byte(content))
+	if err != nil {
+		t.Fatalf("WrapHeader() failed: %v", err)
+	}
+	return plainBytes, header
+}
+
+func TestUnwrapHeader(t *testing.T) {
+	wrapped, header := wrappedObject(t, "secret")
+	empty, emptyHeader := wrappedObject(t, "")
+	tampered := bytes.Replace(wrapped, []byte("secret"), []byte("Secret"), 1)
+	end := bytes.IndexByte(wrapped[len(objectHeaderMagic):], '\n') + len(objectHeaderMagic)
+
+	tests := []struct {
+		name       string
+		plainBytes []byte
+		header     *ObjectHeader
+		content    string
+		ok         bool
+	}{
+		{"header", wrapped, header, "secret", true},
+		{"empty content", empty, emptyHeader, "", true},
+		{"padded", append(append([]byte{}, wrapped...), 0, 0, 0, 0), header, "secret", true},
+		{"no header", []byte("secret"), nil, "secret", true},
+		{"empty", []byte{}, nil, "", true},
+		{"other magic", []byte("tresor-header-v2\n{}\nsecret"), nil, "tresor-header-v2\n{}\nsecret", true},
+		{"partial magic", []byte(objectHeaderMagic[:6]), nil, objectHeaderMagic[:6], true},
+		{"truncated content", wrapped[:len(wrapped)-2], nil, "", false},
+		{"truncated header", wrapped[:end], nil, "", false},
+		{"only magic", []byte(objectHeaderMagic), nil, "", false},
+		{"tampered content", tampered, nil, "", false},
+		{"trailing data", append(append([]byte{}, wrapped...), 0, 'x'), nil, "", false},
+		{"invalid header", []byte(objectHeaderMagic + "{\n"), nil, "", false},
+		{"negative size", []byte(objectHeaderMagic + `{"size":-1}` + "\n"), nil, "", false},
+		{"unterminated header", append([]byte(objectHeaderMagic), bytes.Repeat([]byte(" "), objectHeaderLimit+1)...), nil, "", false},
+	}
+	for _, test := range tests {
+		header, content, err := UnwrapHeader(test.plainBytes)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: UnwrapHeader() error = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(header, test.header) || string(content) != test.content {
+			t.Errorf("%s: UnwrapHeader() = %+v, %q, want %+v, %q", test.name, header, content, test.header, test.content)
+		}
+	}
+}
+
+func TestHeaderCheckerChunks(t *testing.T) {
+	wrapped, header := wrappedObject(t, "secret")
+	padded := append(append([]byte{}, wrapped...), make([]byte, 100)...)
+
+	tests := []struct {
+		name       string
+		plainBytes []byte
+		chunk      int
+		header     *ObjectHeader
+		ok         bool
+	}{
+		{"whole", wrapped, len(wrapped), header, true},
+		{"bytewise", wrapped, 1, header, true},
+		{"split in magic", wrapped, 5, header, true},
+		{"padded bytewise", padded, 1, header, true},
+		{"truncated bytewise", wrapped[:len(wrapped)-1], 1, nil, false},
+		{"no header bytewise", []byte("tresor\nsecret"), 1, nil, true},
+	}
+	for _, test := range tests {
+		checker := &HeaderChecker{}
+		for start := 0; start < len(test.plainBytes); start += test.chunk {
+			end := start + test.chunk
+			if end > len(test.plainBytes) {
+				end = len(test.plainBytes)
+			}
+			if n, err := checker.Write(test.plainBytes[start:end]); err != nil || n != end-start {
+				t.Fatalf("%s: Write() = %d, %v", test.name, n, err)
+			}
+		}
+		header, err := checker.Header()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Header() error = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(header, test.header) {
+			t.Errorf("%s: Header() = %+v, want %+v", test.name, header, test.header)
+		}
+	}
+}
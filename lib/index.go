@@ -0,0 +1,97 @@
+package tresor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IndexObject is the name of the encrypted index of a vault with obfuscated object names
+const IndexObject = "_index"
+
+// NameIndex maps the real names of objects to the keyed-HMAC names they are stored under
+type NameIndex struct {
+	Key     []byte            `json:"key"`     // HMAC key for storage names
+	Objects map[string]string `json:"objects"` // Real name to storage name
+}
+
+// NewNameIndex creates an empty index with a random HMAC key
+func NewNameIndex() (*NameIndex, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate index key: %v", err)
+	}
+	return &NameIndex{Key: key, Objects: map[string]string{}}, nil
+}
+
+// ParseNameIndex parses a decrypted index
+func ParseNameIndex(plainBytes []byte) (*NameIndex, error) {
+	index := &NameIndex{}
+	if err := json.Unmarshal(plainBytes, index); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %v", err)
+	}
+	if len(index.Key) == 0 {
+		return nil, fmt.Errorf("failed to parse index: no key")
+	}
+	if index.Objects == nil {
+		index.Objects = map[string]string{}
+	}
+	return index, nil
+}
+
+// Marshal serializes the index to be encrypted
+func (i *NameIndex) Marshal() ([]byte, error) {
+	return json.Marshal(i)
+}
+
+// StorageName derives the name an object is stored under
+func (i *NameIndex) StorageName(name string) string {
+	mac := hmac.New(sha256.New, i.Key)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Add records an object and returns its storage name
+func (i *NameIndex) Add(name string) string {
+	storageName := i.StorageName(name)
+	i.Objects[name] = storageName
+	return storageName
+}
+
+// Remove forgets an object
+func (i *NameIndex) Remove(name string) {
+	delete(i.Objects, name)
+}
+
+// Lookup returns the storage name of an object
+func (i *NameIndex) Lookup(name string) (string, bool) {
+	storageName, ok := i.Objects[name]
+	return storageName, ok
+}
+
+// Name returns the real name of an object stored under a storage name
+func (i *NameIndex) Name(storageName string) (string, bool) {
+	for name, candidate := range i.Objects {
+		if candidate == storageName {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Names lists the real names of all objects with a prefix in order
+func (i *NameIndex) Names(prefix string) []string {
+	var names []string
+	for name := range i.Objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
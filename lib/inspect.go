@@ -0,0 +1,409 @@
+package tresor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	ageArmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const ageHeader = "age-encryption.org/"
+
+// PayloadInfo describes a stored object as far as it can be told without decrypting it
+type PayloadInfo struct {
+	Format     string
+	Armored    bool
+	Recipients []uint64 // Key IDs the OpenPGP message is encrypted to
+	Symmetric  bool     // OpenPGP message can be decrypted with a passphrase
+	Integrity  string
+}
+
+// PacketField is a detail of a packet
+type PacketField struct {
+	Name  string
+	Value string
+}
+
+// PacketInfo describes a packet of a message. Packets inside decrypted or compressed data are nested deeper.
+type PacketInfo struct {
+	Depth  int
+	Type   string
+	Fields []PacketField
+}
+
+func (p *PacketInfo) add(name string, format string, values ...interface{}) {
+	p.Fields = append(p.Fields, PacketField{Name: name, Value: fmt.Sprintf(format, values...)})
+}
+
+// Inspection lists the packets of a message
+type Inspection struct {
+	Payload   *PayloadInfo
+	Packets   []*PacketInfo
+	Encrypted bool // Encrypted data was not decrypted, so the packets inside are not listed
+}
+
+// InspectPayload reads the beginning of a stored object to tell its format, encoding and recipients
+func InspectPayload(reader io.Reader) (*PayloadInfo, error) {
+	info, body, err := openPayload(reader)
+	if err != nil || info.Format == FormatAge {
+		return info, err
+	}
+
+	packets := packet.NewReader(body)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("object contains no encrypted data")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OpenPGP packets: %v", err)
+		}
+
+		switch key := p.(type) {
+		case *packet.EncryptedKey:
+			info.Recipients = append(info.Recipients, key.KeyId)
+		case *packet.SymmetricKeyEncrypted:
+			info.Symmetric = true
+		}
+		if integrity, ok := encryptedDataIntegrity(p); ok {
+			info.Integrity = integrity
+			return info, nil
+		}
+	}
+}
+
+// InspectMessage lists the packets of a message without verifying it. If decrypt is set, the
+// encrypted data is decrypted with the private keys in the ring or a passphrase to list the packets
+// inside. Packets parsed before an error are returned with it, so broken messages can be examined.
+func InspectMessage(reader io.Reader, ring openpgp.EntityList, decrypt bool) (*Inspection, error) {
+	payload, body, err := openPayload(reader)
+	if err != nil {
+		return nil, err
+	}
+	inspection := &Inspection{Payload: payload}
+	if payload.Format == FormatAge {
+		return inspection, inspectAgeHeader(body, inspection)
+	}
+
+	layers := &packetLayers{}
+	packets := packet.NewReader(layers.push(body, 0))
+	var keys []*packet.EncryptedKey
+	var passphrases []*packet.SymmetricKeyEncrypted
+	var decrypted io.ReadCloser
+	for {
+		p, depth, header, err := layers.next(packets)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return inspection, fmt.Errorf("failed to parse OpenPGP packets: %v", err)
+		}
+		info := &PacketInfo{Depth: depth}
+		inspection.Packets = append(inspection.Packets, info)
+
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			info.Type = "Public-Key Encrypted Session Key"
+			info.add("Version", "%d", p.Version)
+			info.add("Recipient", "%s", keyName(ring, p.KeyId))
+			info.add("Algorithm", "%s", publicKeyAlgorithmName(p.Algo))
+			keys = append(keys, p)
+		case *packet.SymmetricKeyEncrypted:
+			info.Type = "Symmetric-Key Encrypted Session Key"
+			info.add("Version", "%d", p.Version)
+			info.add("Cipher", "%s", cipherName(p.CipherFunc))
+			if p.Version >= 5 {
+				info.add("AEAD", "%s", aeadModeName(p.Mode))
+			}
+			passphrases = append(passphrases, p)
+		case *packet.SymmetricallyEncrypted, *packet.AEADEncrypted:
+			info.Type = "Encrypted Data"
+			integrity, _ := encryptedDataIntegrity(p)
+			info.add("Integrity", "%s", integrity)
+			if encrypted, ok := p.(*packet.SymmetricallyEncrypted); ok {
+				info.add("Version", "%d", encrypted.Version)
+				if encrypted.Version == 2 {
+					info.add("Cipher", "%s", cipherName(encrypted.Cipher))
+				}
+			}
+			if !decrypt {
+				inspection.Encrypted = true
+				return inspection, nil
+			}
+
+			cipher, sessionKey, err := decryptSessionKey(ring, keys, passphrases)
+			if err != nil {
+				return inspection, err
+			}
+			if encrypted, ok := p.(*packet.SymmetricallyEncrypted); !ok || encrypted.Version != 2 {
+				info.add("Cipher", "%s", cipherName(cipher))
+			}
+			switch encrypted := p.(type) {
+			case *packet.SymmetricallyEncrypted:
+				decrypted, err = encrypted.Decrypt(cipher, sessionKey)
+			case *packet.AEADEncrypted:
+				decrypted, err = encrypted.Decrypt(cipher, sessionKey)
+			}
+			if err != nil {
+				return inspection, fmt.Errorf("failed to decrypt data: %v", err)
+			}
+			if err = packets.Push(layers.push(decrypted, depth+1)); err != nil {
+				return inspection, err
+			}
+		case *packet.Compressed:
+			info.Type = "Compressed Data"
+			info.add("Algorithm", "%s", compressionName(compressionAlgorithm(header)))
+			if err = packets.Push(layers.push(p.Body, depth+1)); err != nil {
+				return inspection, err
+			}
+		case *packet.OnePassSignature:
+			info.Type = "One-Pass Signature"
+			info.add("Version", "%d", p.Version)
+			info.add("Type", "0x%02X", uint8(p.SigType))
+			info.add("Hash", "%s", p.Hash.String())
+			info.add("Algorithm", "%s", publicKeyAlgorithmName(p.PubKeyAlgo))
+			info.add("Issuer", "%s", keyName(ring, p.KeyId))
+		case *packet.Signature:
+			info.Type = "Signature"
+			info.add("Version", "%d", p.Version)
+			info.add("Type", "0x%02X", uint8(p.SigType))
+			info.add("Hash", "%s", p.Hash.String())
+			info.add("Algorithm", "%s", publicKeyAlgorithmName(p.PubKeyAlgo))
+			info.add("Created", "%s", p.CreationTime.UTC())
+			if p.IssuerKeyId != nil {
+				info.add("Issuer", "%s", keyName(ring, *p.IssuerKeyId))
+			}
+		case *packet.LiteralData:
+			info.Type = "Literal Data"
+			info.add("Format", "%q", rune(p.Format))
+			info.add("Filename", "%q", p.FileName)
+			if p.Time != 0 {
+				info.add("Modified", "%s", time.Unix(int64(p.Time), 0).UTC())
+			}
+			size, err := io.Copy(ioutil.Discard, p.Body)
+			if err != nil {
+				return inspection, fmt.Errorf("failed to read literal data: %v", err)
+			}
+			info.add("Size", "%d bytes", size)
+		default:
+			info.Type = strings.TrimPrefix(fmt.Sprintf("%T", p), "*packet.")
+		}
+	}
+
+	// The integrity of the decrypted data is only checked once it was read completely
+	if decrypted != nil {
+		if err = decrypted.Close(); err != nil {
+			return inspection, fmt.Errorf("failed to verify integrity: %v", err)
+		}
+	}
+	return inspection, nil
+}
+
+// openPayload tells the format and encoding of a message and returns its decoded body
+func openPayload(reader io.Reader) (*PayloadInfo, io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	start, _ := buffered.Peek(len(ageArmor.Header))
+	if len(start) == 0 {
+		return nil, nil, fmt.Errorf("object is empty")
+	}
+
+	switch {
+	case bytes.HasPrefix(start, []byte(ageArmor.Header)):
+		return &PayloadInfo{Format: FormatAge, Armored: true, Integrity: "ChaCha20-Poly1305"}, ageArmor.NewReader(buffered), nil
+	case bytes.HasPrefix(start, []byte(ageHeader)):
+		return &PayloadInfo{Format: FormatAge, Integrity: "ChaCha20-Poly1305"}, buffered, nil
+	}
+
+	body, armored, err := openPGPBody(buffered)
+	if err != nil {
+		return nil, nil, fmt.Errorf("object is neither an OpenPGP message nor an age file: %v", err)
+	}
+	return &PayloadInfo{Format: FormatOpenPGP, Armored: armored}, body, nil
+}
+
+// inspectAgeHeader lists the recipient stanzas of an age file
+func inspectAgeHeader(body io.Reader, inspection *Inspection) error {
+	lines := bufio.NewScanner(body)
+	if !lines.Scan() || !strings.HasPrefix(lines.Text(), ageHeader) {
+		return fmt.Errorf("failed to parse age header")
+	}
+	version := &PacketInfo{Type: "Header"}
+	version.add("Version", "%s", strings.TrimPrefix(lines.Text(), ageHeader))
+	inspection.Packets = append(inspection.Packets, version)
+
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "---") {
+			inspection.Encrypted = true
+			return nil
+		}
+		if !strings.HasPrefix(line, "-> ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "-> "))
+		stanza := &PacketInfo{Type: "Recipient Stanza"}
+		if len(fields) > 0 {
+			stanza.add("Type", "%s", fields[0])
+		}
+		inspection.Packets = append(inspection.Packets, stanza)
+	}
+	return fmt.Errorf("age header is truncated")
+}
+
+// decryptSessionKey decrypts the session key of a message with a private key or a passphrase
+func decryptSessionKey(ring openpgp.EntityList, keys []*packet.EncryptedKey, passphrases []*packet.SymmetricKeyEncrypted) (packet.CipherFunction, []byte, error) {
+	for _, encryptedKey := range keys {
+		for _, key := range ring.KeysById(encryptedKey.KeyId) {
+			if key.PrivateKey == nil {
+				continue
+			}
+			if key.PrivateKey.Encrypted {
+				if cipher, sessionKey, err := agentSessionKey(encryptedKey); err == nil {
+					return cipher, sessionKey, nil
+				}
+			}
+			if _, err := unlockKey(key.PrivateKey); err != nil {
+				return 0, nil, err
+			}
+			if err := encryptedKey.Decrypt(key.PrivateKey, nil); err == nil {
+				return encryptedKey.CipherFunc, encryptedKey.Key, nil
+			}
+		}
+	}
+
+	if len(passphrases) == 0 {
+		return 0, nil, fmt.Errorf("no private key matching the message")
+	}
+	passphrase, err := GetUserPassword(SymmetricKeyID)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, encryptedKey := range passphrases {
+		if sessionKey, cipher, err := encryptedKey.Decrypt(passphrase); err == nil {
+			return cipher, sessionKey, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("failed to decrypt session key: %w", ErrBadPassphrase)
+}
+
+// packetLayers records the bytes read for every nested packet stream while the next packet is
+// parsed, to tell where it was found and what its header was
+type packetLayers struct {
+	layers []*packetLayer
+}
+
+type packetLayer struct {
+	reader    io.Reader
+	depth     int
+	recording bool
+	read      []byte
+}
+
+func (l *packetLayer) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	if l.recording {
+		l.read = append(l.read, p[:n]...)
+	}
+	return n, err
+}
+
+func (l *packetLayers) push(reader io.Reader, depth int) io.Reader {
+	layer := &packetLayer{reader: reader, depth: depth}
+	l.layers = append(l.layers, layer)
+	return layer
+}
+
+// next parses the next packet and returns its depth and the bytes read from its stream
+func (l *packetLayers) next(packets *packet.Reader) (packet.Packet, int, []byte, error) {
+	for _, layer := range l.layers {
+		layer.recording, layer.read = true, nil
+	}
+	p, err := packets.Next()
+	for _, layer := range l.layers {
+		layer.recording = false
+	}
+
+	// Reading from a nested stream reads from the streams below it, so the deepest one is the source
+	for i := len(l.layers) - 1; i >= 0; i-- {
+		if len(l.layers[i].read) > 0 {
+			return p, l.layers[i].depth, l.layers[i].read, err
+		}
+	}
+	return p, 0, nil, err
+}
+
+// compressionAlgorithm reads the algorithm of a compressed data packet, which follows its header
+func compressionAlgorithm(packetBytes []byte) int {
+	if len(packetBytes) < 2 {
+		return -1
+	}
+	length := 2
+	if packetBytes[0]&0x40 == 0 {
+		// Legacy format, the length type is in the tag
+		switch packetBytes[0] & 3 {
+		case 1:
+			length = 3
+		case 2:
+			length = 5
+		case 3:
+			length = 1
+		}
+	} else if first := packetBytes[1]; first >= 192 && first < 224 {
+		length = 3
+	} else if first == 255 {
+		length = 6
+	}
+	if len(packetBytes) <= length {
+		return -1
+	}
+	return int(packetBytes[length])
+}
+
+func keyName(ring openpgp.EntityList, keyID uint64) string {
+	if keyID == 0 {
+		return "anonymous"
+	}
+	if keys := ring.KeysById(keyID); len(keys) > 0 {
+		return fmt.Sprintf("%016X, %s", keyID, PrimaryIdentity(keys[0].Entity))
+	}
+	return fmt.Sprintf("%016X", keyID)
+}
+
+func cipherName(cipher packet.CipherFunction) string {
+	switch cipher {
+	case packet.Cipher3DES:
+		return "3DES"
+	case packet.CipherCAST5:
+		return "CAST5"
+	case packet.CipherAES128:
+		return "AES128"
+	case packet.CipherAES192:
+		return "AES192"
+	case packet.CipherAES256:
+		return "AES256"
+	}
+	return fmt.Sprintf("cipher %d", cipher)
+}
+
+func compressionName(algorithm int) string {
+	switch algorithm {
+	case int(packet.CompressionNone):
+		return "NONE"
+	case int(packet.CompressionZIP):
+		return "ZIP"
+	case int(packet.CompressionZLIB):
+		return "ZLIB"
+	case 3:
+		return "BZIP2"
+	case -1:
+		return "unknown"
+	}
+	return fmt.Sprintf("algorithm %d", algorithm)
+}
@@ -0,0 +1,318 @@
+package tresor
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ExpiryWarning is how long before its expiry a key is reported as expiring soon
+const ExpiryWarning = 30 * 24 * time.Hour
+
+// KeyStatus describes whether a key can be used at a point in time
+type KeyStatus struct {
+	Revoked bool
+	Expired bool
+	Expiry  time.Time // Zero if the key never expires
+	Encrypt bool      // Key has a valid encryption key
+	Sign    bool      // Key has a valid signing key
+}
+
+// CheckKey determines the status of a key at a point in time
+func CheckKey(entity *openpgp.Entity, now time.Time) *KeyStatus {
+	status := &KeyStatus{
+		Revoked: entity.Revoked(now),
+		Expiry:  KeyExpiry(entity),
+	}
+	if selfSignature, identity := entity.PrimarySelfSignature(); selfSignature == nil {
+		status.Expired = true
+	} else {
+		status.Expired = entity.PrimaryKey.KeyExpired(selfSignature, now) || selfSignature.SigExpired(now)
+		if identity != nil && identity.Revoked(now) {
+			status.Revoked = true
+		}
+	}
+	_, status.Encrypt = entity.EncryptionKey(now)
+	_, status.Sign = entity.SigningKey(now)
+	return status
+}
+
+// ExpiresSoon reports whether the key expires within the warning period
+func (s *KeyStatus) ExpiresSoon(now time.Time) bool {
+	return !s.Expiry.IsZero() && s.Expiry.Sub(now) < ExpiryWarning
+}
+
+// String summarizes the status
+func (s *KeyStatus) String() string {
+	switch {
+	case s.Revoked:
+		return "revoked"
+	case s.Expired && s.Expiry.IsZero():
+		return "expired"
+	case s.Expired:
+		return fmt.Sprintf("expired on %s", s.Expiry.Format("2006-01-02"))
+	case s.ExpiresSoon(time.Now()):
+		return fmt.Sprintf("expires soon on %s", s.Expiry.Format("2006-01-02"))
+	case !s.Encrypt && !s.Sign:
+		return "no usable subkeys"
+	}
+	return "valid"
+}
+
+// CheckRecipient makes sure objects can be encrypted to a key and warns if it expires soon
+func CheckRecipient(entity *openpgp.Entity) error {
+	return checkUsable(entity, "recipient", func(status *KeyStatus) bool { return status.Encrypt })
+}
+
+// CheckSigner makes sure objects can be signed with a key and warns if it expires soon
+func CheckSigner(entity *openpgp.Entity) error {
+	return checkUsable(entity, "signing", func(status *KeyStatus) bool { return status.Sign })
+}
+
+func checkUsable(entity *openpgp.Entity, role string, usable func(*KeyStatus) bool) error {
+	now := time.Now()
+	status := CheckKey(entity, now)
+	name := fmt.Sprintf("%s (%s)", PrimaryIdentity(entity), Fingerprint(entity))
+
+	if status.Revoked {
+		return fmt.Errorf("%s key %s is revoked", role, name)
+	}
+	if status.Expired {
+		return fmt.Errorf("%s key %s expired on %s", role, name, status.Expiry.Format("2006-01-02"))
+	}
+	if !usable(status) {
+		return fmt.Errorf("%s key %s has no valid subkey for this purpose", role, name)
+	}
+	if status.ExpiresSoon(now) {
+		fmt.Fprintf(os.Stderr, "Warning: %s key %s expires on %s.\n", role, name, status.Expiry.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// MaxKeyLifetime is the longest lifetime OpenPGP can record for a key, about 136 years
+const MaxKeyLifetime = math.MaxUint32 * time.Second
+
+// KeySpec describes a key pair to generate
+type KeySpec struct {
+	Name      string
+	Comment   string
+	Email     string
+	Algorithm string        // ed25519, rsa3072 or rsa4096
+	V6        bool          // Generate an RFC 9580 version 6 key
+	Lifetime  time.Duration // Time until the key expires, never if 0
+}
+
+// GenerateKey creates a new key pair with a signing primary key and an encryption subkey.
+// The algorithm preferences advertised by the key are taken from the settings.
+func GenerateKey(spec *KeySpec, settings *CryptoSettings) (*openpgp.Entity, error) {
+	if settings == nil {
+		settings = DefaultCryptoSettings()
+	}
+	config, err := settings.PacketConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(spec.Algorithm) {
+	case "", "ed25519":
+		config.Algorithm = packet.PubKeyAlgoEdDSA
+		if spec.V6 {
+			config.Algorithm = packet.PubKeyAlgoEd25519
+		}
+	case "rsa3072":
+		config.Algorithm = packet.PubKeyAlgoRSA
+		config.RSABits = 3072
+	case "rsa4096":
+		config.Algorithm = packet.PubKeyAlgoRSA
+		config.RSABits = 4096
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %s", spec.Algorithm)
+	}
+	if spec.Lifetime < 0 || spec.Lifetime > MaxKeyLifetime {
+		return nil, fmt.Errorf("unsupported key lifetime: %s", spec.Lifetime)
+	}
+	config.V6Keys = spec.V6
+	config.KeyLifetimeSecs = uint32(spec.Lifetime / time.Second)
+
+	entity, err := openpgp.NewEntity(spec.Name, spec.Comment, spec.Email, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return entity, nil
+}
+
+// ProtectPrivateKeys encrypts all private keys of an unlocked entity with a passphrase, using the
+// S2K from the settings. Keys are left unprotected if the passphrase is empty.
+func ProtectPrivateKeys(entity *openpgp.Entity, passphrase []byte, settings *CryptoSettings) error {
+	if len(passphrase) == 0 {
+		return nil
+	}
+	if settings == nil {
+		settings = DefaultCryptoSettings()
+	}
+	config, err := settings.PacketConfig()
+	if err != nil {
+		return err
+	}
+	if config.S2KConfig.S2KCount == 0 {
+		config.S2KConfig.S2KCount = maxS2KCount
+	}
+
+	if err = entity.EncryptPrivateKeys(passphrase, config); err != nil {
+		return fmt.Errorf("failed to encrypt private key: %v", err)
+	}
+	return nil
+}
+
+// UnlockEntity decrypts the primary key and all subkeys of an entity. Subkeys are
+// tried with the passphrase of the primary key first.
+func UnlockEntity(entity *openpgp.Entity) error {
+	if entity.PrivateKey == nil {
+		return fmt.Errorf("key %s has no private key", entity.PrimaryKey.KeyIdString())
+	}
+
+	passphrase, err := unlockKey(entity.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey == nil || !subkey.PrivateKey.Encrypted {
+			continue
+		}
+		if passphrase != nil && subkey.PrivateKey.Decrypt(passphrase) == nil {
+			continue
+		}
+		if _, err = unlockKey(subkey.PrivateKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteArmoredKey writes the public or private part of an entity to local disk. Existing
+// files are replaced atomically, private keys are only readable by the owner.
+func WriteArmoredKey(location string, entity *openpgp.Entity, private bool) error {
+	blockType, mode := openpgp.PublicKeyType, os.FileMode(0644)
+	if private {
+		blockType, mode = openpgp.PrivateKeyType, os.FileMode(0600)
+	}
+
+	err := writeFileAtomic(location, mode, func(writer io.Writer) error {
+		output, err := armor.Encode(writer, blockType, nil)
+		if err != nil {
+			return fmt.Errorf("failed to open armor writer: %v", err)
+		}
+		if private {
+			// Self-signatures are kept, as private keys may be encrypted already
+			err = entity.SerializePrivateWithoutSigning(output, nil)
+		} else {
+			err = entity.Serialize(output)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to serialize key: %v", err)
+		}
+		if err = output.Close(); err != nil {
+			return fmt.Errorf("failed to armor key: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write key: %v", err)
+	}
+	return nil
+}
+
+// KeyAlgorithm describes the algorithm and size of a public key
+func KeyAlgorithm(key *packet.PublicKey) string {
+	name := publicKeyAlgorithmName(key.PubKeyAlgo)
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoX25519, packet.PubKeyAlgoX448, packet.PubKeyAlgoEd25519, packet.PubKeyAlgoEd448:
+		// The name already implies the curve
+		return name
+	}
+
+	if curve, err := key.Curve(); err == nil {
+		return fmt.Sprintf("%s (%s)", name, curve)
+	}
+	if bits, err := key.BitLength(); err == nil {
+		return fmt.Sprintf("%s %d", name, bits)
+	}
+	return name
+}
+
+// publicKeyAlgorithmName names a public key algorithm
+func publicKeyAlgorithmName(algorithm packet.PublicKeyAlgorithm) string {
+	switch algorithm {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		return "RSA"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case packet.PubKeyAlgoEdDSA:
+		return "EdDSA"
+	case packet.PubKeyAlgoX25519:
+		return "X25519"
+	case packet.PubKeyAlgoX448:
+		return "X448"
+	case packet.PubKeyAlgoEd25519:
+		return "Ed25519"
+	case packet.PubKeyAlgoEd448:
+		return "Ed448"
+	}
+	return fmt.Sprintf("algorithm %d", algorithm)
+}
+
+// KeyExpiry returns when the primary key of an entity expires, or the zero time if it never does
+func KeyExpiry(entity *openpgp.Entity) time.Time {
+	selfSignature, _ := entity.PrimarySelfSignature()
+	if selfSignature == nil {
+		return time.Time{}
+	}
+	return expiry(entity.PrimaryKey, selfSignature)
+}
+
+// SubkeyExpiry returns when a subkey expires, or the zero time if it never does
+func SubkeyExpiry(subkey *openpgp.Subkey) time.Time {
+	return expiry(subkey.PublicKey, subkey.Sig)
+}
+
+// KeyUsage lists the capabilities a signature grants a key
+func KeyUsage(signature *packet.Signature) string {
+	if signature == nil || !signature.FlagsValid {
+		return "unknown"
+	}
+	var usage []string
+	if signature.FlagCertify {
+		usage = append(usage, "certify")
+	}
+	if signature.FlagSign {
+		usage = append(usage, "sign")
+	}
+	if signature.FlagEncryptCommunications || signature.FlagEncryptStorage {
+		usage = append(usage, "encrypt")
+	}
+	if signature.FlagAuthenticate {
+		usage = append(usage, "authenticate")
+	}
+	return strings.Join(usage, ", ")
+}
+
+func expiry(key *packet.PublicKey, signature *packet.Signature) time.Time {
+	if signature == nil || signature.KeyLifetimeSecs == nil || *signature.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return key.CreationTime.Add(time.Duration(*signature.KeyLifetimeSecs) * time.Second)
+}
@@ -0,0 +1,51 @@
+package tresor
+
+import (
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+func TestKeyAlgorithm(t *testing.T) {
+	entity := testEntity(t, "Alice", "alice@example.com")
+
+	tests := []struct {
+		name string
+		key  *packet.PublicKey
+		want string
+	}{
+		{"primary key", entity.PrimaryKey, "EdDSA (Curve25519)"},
+		{"encryption subkey", entity.Subkeys[0].PublicKey, "ECDH (Curve25519)"},
+		{"X25519", &packet.PublicKey{PubKeyAlgo: packet.PubKeyAlgoX25519}, "X25519"},
+		{"Ed448", &packet.PublicKey{PubKeyAlgo: packet.PubKeyAlgoEd448}, "Ed448"},
+		{"unknown", &packet.PublicKey{PubKeyAlgo: 99}, "algorithm 99"},
+	}
+	for _, test := range tests {
+		if got := KeyAlgorithm(test.key); got != test.want {
+			t.Errorf("%s: KeyAlgorithm() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPublicKeyAlgorithmName(t *testing.T) {
+	tests := []struct {
+		algorithm packet.PublicKeyAlgorithm
+		want      string
+	}{
+		{packet.PubKeyAlgoRSA, "RSA"},
+		{packet.PubKeyAlgoRSASignOnly, "RSA"},
+		{packet.PubKeyAlgoElGamal, "ElGamal"},
+		{packet.PubKeyAlgoDSA, "DSA"},
+		{packet.PubKeyAlgoECDH, "ECDH"},
+		{packet.PubKeyAlgoECDSA, "ECDSA"},
+		{packet.PubKeyAlgoEdDSA, "EdDSA"},
+		{packet.PubKeyAlgoX448, "X448"},
+		{packet.PubKeyAlgoEd25519, "Ed25519"},
+		{99, "algorithm 99"},
+	}
+	for _, test := range tests {
+		if got := publicKeyAlgorithmName(test.algorithm); got != test.want {
+			t.Errorf("publicKeyAlgorithmName(%d) = %q, want %q", test.algorithm, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package tresor
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// MetadataSignature is the metadata key holding the signature over the other metadata of an object
+const MetadataSignature = "Metadata-Signature"
+
+// CanonicalMetadata serializes the metadata of an object to be signed. The object name and
+// generation are covered, so signed metadata cannot be moved to another object or version.
+func CanonicalMetadata(name string, generation int64, contentType string, metadata map[string]string) ([]byte, error) {
+	signed := map[string]string{}
+	for key, value := range metadata {
+		if key != MetadataSignature {
+			signed[key] = value
+		}
+	}
+
+	// Maps are encoded with sorted keys
+	canonical, err := json.Marshal(struct {
+		Name        string            `json:"name"`
+		Generation  int64             `json:"generation"`
+		ContentType string            `json:"content_type"`
+		Metadata    map[string]string `json:"metadata"`
+	}{name, generation, contentType, signed})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	return canonical, nil
+}
+
+// SignMetadata signs the metadata to be written for a generation of an object and adds the signature to it
+func SignMetadata(signer *openpgp.Entity, name string, generation int64, meta *storage.ObjectAttrsToUpdate, settings *CryptoSettings) error {
+	contentType, _ := meta.ContentType.(string)
+	canonical, err := CanonicalMetadata(name, generation, contentType, meta.Metadata)
+	if err != nil {
+		return err
+	}
+
+	signature, err := signDetached(signer, canonical, settings)
+	if err != nil {
+		return fmt.Errorf("failed to sign metadata: %v", err)
+	}
+	meta.Metadata[MetadataSignature] = signature
+	return nil
+}
+
+// VerifyMetadata checks the signature over the metadata of an object. Unsigned metadata is reported
+// as unsigned, any other failure means the metadata or its signature were changed.
+func VerifyMetadata(ring openpgp.EntityList, name string, attrs *storage.ObjectAttrs) (*Signature, error) {
+	encoded, ok := attrs.Metadata[MetadataSignature]
+	if !ok {
+		return &Signature{}, nil
+	}
+
+	canonical, err := CanonicalMetadata(name, attrs.Generation, attrs.ContentType, attrs.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return checkDetached(ring, canonical, encoded)
+}
@@ -0,0 +1,77 @@
+package tresor
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// PaddingNone stores the plaintext as it is
+	PaddingNone = "none"
+	// PaddingPowerOfTwo pads the plaintext to the next power of two
+	PaddingPowerOfTwo = "power2"
+	// PaddingBlock pads the plaintext to the next multiple of the block size
+	PaddingBlock = "block"
+
+	defaultPaddingBlock = 1024
+)
+
+// Padding hides the size of objects by appending zeros to the plaintext before encryption.
+// Only objects with header can be padded, the header records the size to strip the padding.
+type Padding struct {
+	Scheme string // none, power2 or block
+	Block  int    // Block size, and minimum size for power2
+}
+
+// Check makes sure the padding scheme is supported
+func (p *Padding) Check() error {
+	switch strings.ToLower(p.Scheme) {
+	case "", PaddingNone, PaddingPowerOfTwo, PaddingBlock:
+	default:
+		return fmt.Errorf("unsupported padding: %s", p.Scheme)
+	}
+	if p.Block < 0 {
+		return fmt.Errorf("invalid padding block size: %d", p.Block)
+	}
+	return nil
+}
+
+// Enabled reports whether plaintexts are padded at all
+func (p *Padding) Enabled() bool {
+	scheme := strings.ToLower(p.Scheme)
+	return scheme != "" && scheme != PaddingNone
+}
+
+// Size returns the padded size of a plaintext
+func (p *Padding) Size(size int) int {
+	block := p.Block
+	if block == 0 {
+		block = defaultPaddingBlock
+	}
+
+	switch strings.ToLower(p.Scheme) {
+	case PaddingPowerOfTwo:
+		padded := block
+		for padded < size {
+			padded *= 2
+		}
+		return padded
+	case PaddingBlock:
+		return (size + block - 1) / block * block
+	}
+	return size
+}
+
+// Pad appends zeros to a plaintext up to its padded size
+func (p *Padding) Pad(plainBytes []byte) ([]byte, error) {
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	size := p.Size(len(plainBytes))
+	if size == len(plainBytes) {
+		return plainBytes, nil
+	}
+	padded := make([]byte, size)
+	copy(padded, plainBytes)
+	return padded, nil
+}
@@ -0,0 +1,95 @@
+package tresor
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingSize(t *testing.T) {
+	tests := []struct {
+		scheme string
+		block  int
+		size   int
+		padded int
+	}{
+		{"", 0, 100, 100},
+		{PaddingNone, 0, 100, 100},
+		{PaddingPowerOfTwo, 0, 1, 1024},
+		{PaddingPowerOfTwo, 0, 1024, 1024},
+		{PaddingPowerOfTwo, 0, 1025, 2048},
+		{PaddingPowerOfTwo, 0, 5000, 8192},
+		{PaddingPowerOfTwo, 256, 100, 256},
+		{PaddingPowerOfTwo, 256, 257, 512},
+		{"POWER2", 256, 257, 512},
+		{PaddingBlock, 0, 1, 1024},
+		{PaddingBlock, 0, 1024, 1024},
+		{PaddingBlock, 0, 1025, 2048},
+		{PaddingBlock, 0, 5000, 5120},
+		{PaddingBlock, 100, 250, 300},
+		{PaddingBlock, 100, 300, 300},
+	}
+	for _, test := range tests {
+		padding := &Padding{Scheme: test.scheme, Block: test.block}
+		if padded := padding.Size(test.size); padded != test.padded {
+			t.Errorf("%s/%d: Size(%d) = %d, want %d", test.scheme, test.block, test.size, padded, test.padded)
+		}
+	}
+}
+
+func TestPaddingCheck(t *testing.T) {
+	tests := []struct {
+		scheme string
+		block  int
+		ok     bool
+	}{
+		{"", 0, true},
+		{PaddingNone, 0, true},
+		{PaddingPowerOfTwo, 0, true},
+		{"Block", 512, true},
+		{"random", 0, false},
+		{PaddingBlock, -1, false},
+	}
+	for _, test := range tests {
+		padding := &Padding{Scheme: test.scheme, Block: test.block}
+		if err := padding.Check(); (err == nil) != test.ok {
+			t.Errorf("%s/%d: Check() error = %v, want ok %v", test.scheme, test.block, err, test.ok)
+		}
+		if _, err := padding.Pad([]byte("secret")); (err == nil) != test.ok {
+			t.Errorf("%s/%d: Pad() error = %v, want ok %v", test.scheme, test.block, err, test.ok)
+		}
+	}
+}
+
+func TestPadAndUnpad(t *testing.T) {
+	tests := []struct {
+		scheme  string
+		block   int
+		content []byte
+	}{
+		{PaddingNone, 0, []byte("secret")},
+		{PaddingPowerOfTwo, 0, []byte("secret")},
+		{PaddingPowerOfTwo, 64, bytes.Repeat([]byte("x"), 1000)},
+		{PaddingBlock, 0, []byte("secret")},
+		{PaddingBlock, 16, bytes.Repeat([]byte("x"), 1000)},
+		{PaddingBlock, 0, []byte{}},
+		{PaddingBlock, 0, []byte("ends with zeros\x00\x00")},
+	}
+	for _, test := range tests {
+		padding := &Padding{Scheme: test.scheme, Block: test.block}
+		plainBytes, header := wrappedObject(t, string(test.content))
+
+		padded, err := padding.Pad(plainBytes)
+		if err != nil {
+			t.Fatalf("%s/%d: Pad() failed: %v", test.scheme, test.block, err)
+		}
+		if len(padded) != padding.Size(len(plainBytes)) || !bytes.HasPrefix(padded, plainBytes) {
+			t.Errorf("%s/%d: Pad() returned %d bytes, want %d starting with the plaintext", test.scheme, test.block, len(padded), padding.Size(len(plainBytes)))
+		}
+
+		// The header records the size, so unwrapping strips the padding
+		unwrapped, content, err := UnwrapHeader(padded)
+		if err != nil || unwrapped.SHA256 != header.SHA256 || !bytes.Equal(content, test.content) {
+			t.Errorf("%s/%d: UnwrapHeader() = %q, %v, want %q", test.scheme, test.block, content, err, test.content)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package tresor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PassphraseProvider supplies the passphrase for the private key with the given ID
+type PassphraseProvider func(keyID string) ([]byte, error)
+
+// ErrBadPassphrase is returned once all attempts to unlock a private key failed
+var ErrBadPassphrase = errors.New("bad passphrase")
+
+var (
+	passphraseProvider PassphraseProvider = TerminalPassphrase
+	passphraseRetries                     = 3
+)
+
+// SetPassphraseProvider replaces the source GetUserPassword reads passphrases from
+func SetPassphraseProvider(provider PassphraseProvider) {
+	passphraseProvider = provider
+}
+
+// SetPassphraseRetries sets how often a passphrase is requested before giving up
+func SetPassphraseRetries(retries int) {
+	if retries < 1 {
+		retries = 1
+	}
+	passphraseRetries = retries
+}
+
+// TerminalPassphrase prompts for a passphrase on the terminal
+func TerminalPassphrase(keyID string) ([]byte, error) {
+	if !TerminalAvailable() {
+		return nil, fmt.Errorf("no terminal to prompt for the passphrase of key %s. Configure a non-interactive 'passphrase_source'", keyID)
+	}
+	fmt.Fprintf(os.Stderr, "Enter Password for key %s: ", keyID)
+	passwordBytes, err := ReadTerminalSecret()
+	fmt.Fprintln(os.Stderr, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user password: %v", err)
+	}
+	return passwordBytes, nil
+}
+
+// ReadTerminalSecret reads a line from the terminal without echoing it. If STDIN is not a
+// terminal, for example because the input is piped, the controlling terminal is read instead.
+func ReadTerminalSecret() ([]byte, error) {
+	if terminal.IsTerminal(int(syscall.Stdin)) {
+		return terminal.ReadPassword(int(syscall.Stdin))
+	}
+	tty, err := os.OpenFile(controllingTerminal(), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal available: %v", err)
+	}
+	defer tty.Close()
+	return terminal.ReadPassword(int(tty.Fd()))
+}
+
+// TerminalAvailable reports whether secrets can be read from a terminal
+func TerminalAvailable() bool {
+	if terminal.IsTerminal(int(syscall.Stdin)) {
+		return true
+	}
+	tty, err := os.OpenFile(controllingTerminal(), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
+
+func controllingTerminal() string {
+	if runtime.GOOS == "windows" {
+		return "CONIN$"
+	}
+	return "/dev/tty"
+}
+
+// NoPassphrase refuses to supply passphrases, for use with unencrypted private keys only
+func NoPassphrase(keyID string) ([]byte, error) {
+	return nil, fmt.Errorf("private key %s is encrypted, but no passphrase source is configured", keyID)
+}
+
+// EnvPassphrase reads the passphrase from an environment variable
+func EnvPassphrase(name string) PassphraseProvider {
+	return func(keyID string) ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s for passphrase is not set", name)
+		}
+		return []byte(value), nil
+	}
+}
+
+// FileDescriptorPassphrase reads the passphrase from the first line of an open file descriptor.
+// A descriptor can only be consumed once, so the passphrase is kept for subsequent calls.
+func FileDescriptorPassphrase(fd uintptr) PassphraseProvider {
+	var (
+		once       sync.Once
+		passphrase []byte
+		readErr    error
+	)
+	return func(keyID string) ([]byte, error) {
+		once.Do(func() {
+			file := os.NewFile(fd, fmt.Sprintf("fd%d", fd))
+			if file == nil {
+				readErr = fmt.Errorf("invalid passphrase file descriptor: %d", fd)
+				return
+			}
+			defer file.Close()
+			passphrase, readErr = readFirstLine(file)
+		})
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read passphrase from file descriptor: %v", readErr)
+		}
+		return passphrase, nil
+	}
+}
+
+// FilePassphrase reads the passphrase from the first line of a local file, which
+// must not be accessible by group or others
+func FilePassphrase(location string) PassphraseProvider {
+	return func(keyID string) ([]byte, error) {
+		info, err := os.Stat(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("passphrase file is not a regular file: %s", location)
+		}
+		// Windows does not map ACLs to permission bits
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("refusing to use passphrase file %s with permissions %v. Restrict it to 0600", location, info.Mode().Perm())
+		}
+
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %v", err)
+		}
+		defer file.Close()
+
+		return readFirstLine(file)
+	}
+}
+
+// CommandPassphrase runs an external command and uses the first line of its output as passphrase.
+// The key ID is exposed to the command as TRESOR_KEY_ID.
+func CommandPassphrase(command string) PassphraseProvider {
+	return func(keyID string) ([]byte, error) {
+		cmd := shellCommand(command)
+		cmd.Env = append(os.Environ(), "TRESOR_KEY_ID="+keyID)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run passphrase command: %v", err)
+		}
+		return readFirstLine(bytes.NewReader(out))
+	}
+}
+
+// PinentryPassphrase asks a pinentry program for the passphrase using the Assuan protocol
+func PinentryPassphrase(program string) PassphraseProvider {
+	return func(keyID string) ([]byte, error) {
+		cmd := exec.Command(program)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pinentry: %v", err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pinentry: %v", err)
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start pinentry: %v", err)
+		}
+		defer cmd.Wait()
+		defer stdin.Close()
+
+		reader := bufio.NewReader(stdout)
+		if _, err = pinentryResponse(reader); err != nil {
+			return nil, err
+		}
+
+		commands := []string{
+			"SETTITLE tresor",
+			"SETDESC " + pinentryEscape(fmt.Sprintf("Enter passphrase for key %s", keyID)),
+			"SETPROMPT Passphrase:",
+		}
+		for _, command := range commands {
+			if _, err = fmt.Fprintln(stdin, command); err != nil {
+				return nil, fmt.Errorf("failed to talk to pinentry: %v", err)
+			}
+			if _, err = pinentryResponse(reader); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err = fmt.Fprintln(stdin, "GETPIN"); err != nil {
+			return nil, fmt.Errorf("failed to talk to pinentry: %v", err)
+		}
+		pin, err := pinentryResponse(reader)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(stdin, "BYE")
+
+		return pin, nil
+	}
+}
+
+// pinentryResponse reads lines up to the final OK and returns any data received
+func pinentryResponse(reader *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from pinentry: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, fmt.Errorf("pinentry failed: %s", strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			decoded, err := url.PathUnescape(strings.TrimPrefix(line, "D "))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode pinentry data: %v", err)
+			}
+			data = append(data, decoded...)
+		}
+	}
+}
+
+func pinentryEscape(value string) string {
+	value = strings.ReplaceAll(value, "%", "%25")
+	value = strings.ReplaceAll(value, "\n", "%0A")
+	return strings.ReplaceAll(value, "\r", "%0D")
+}
+
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+func readFirstLine(reader io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(reader).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
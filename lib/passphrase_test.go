@@ -0,0 +1,84 @@
+package tresor
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestPinentryResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		data     string
+		ok       bool
+	}{
+		{"greeting", "OK Pleased to meet you\n", "", true},
+		{"plain ok", "OK\n", "", true},
+		{"carriage return", "OK\r\n", "", true},
+		{"data", "D secret\nOK\n", "secret", true},
+		{"split data", "D sec\nD ret\nOK\n", "secret", true},
+		{"escaped data", "D 100%25%0Ado%0Dne\nOK\n", "100%\ndo\rne", true},
+		{"plus is not a space", "D a+b\nOK\n", "a+b", true},
+		{"status and comments", "# comment\nS PASSPHRASE_QUALITY 0\nD secret\nOK\n", "secret", true},
+		{"error", "ERR 83886179 Operation cancelled <Pinentry>\n", "", false},
+		{"error after data", "D secret\nERR 83886179 Operation cancelled\n", "", false},
+		{"bad escape", "D %ZZ\nOK\n", "", false},
+		{"no ok", "D secret\n", "", false},
+		{"okay is not ok", "OKAY\n", "", false},
+		{"empty", "", "", false},
+	}
+	for _, test := range tests {
+		data, err := pinentryResponse(bufio.NewReader(strings.NewReader(test.response)))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: pinentryResponse() error = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if string(data) != test.data {
+			t.Errorf("%s: pinentryResponse() = %q, want %q", test.name, data, test.data)
+		}
+	}
+}
+
+func TestPinentryEscape(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Enter passphrase", "Enter passphrase"},
+		{"100%", "100%25"},
+		{"line\nbreak", "line%0Abreak"},
+		{"carriage\rreturn", "carriage%0Dreturn"},
+		{"%0A", "%250A"},
+	}
+	for _, test := range tests {
+		if got := pinentryEscape(test.value); got != test.want {
+			t.Errorf("pinentryEscape(%q) = %q, want %q", test.value, got, test.want)
+		}
+		// What is escaped for pinentry has to come back unchanged
+		data, err := pinentryResponse(bufio.NewReader(strings.NewReader("D " + pinentryEscape(test.value) + "\nOK\n")))
+		if err != nil || string(data) != test.value {
+			t.Errorf("pinentryResponse() of %q = %q, %v", test.value, data, err)
+		}
+	}
+}
+
+func TestReadFirstLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"line", "secret\n", "secret"},
+		{"crlf", "secret\r\n", "secret"},
+		{"no newline", "secret", "secret"},
+		{"only first line", "secret\nother\n", "secret"},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		line, err := readFirstLine(strings.NewReader(test.input))
+		if err != nil || string(line) != test.want {
+			t.Errorf("%s: readFirstLine() = %q, %v, want %q", test.name, line, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tresor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// KeyChangedError is returned if an identity presents a different key than the one pinned for it
+type KeyChangedError struct {
+	Vault     string
+	Identity  string
+	Pinned    string // Fingerprint of the pinned key
+	Presented string // Fingerprint of the key presented now
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("key for %s in vault %s changed from %s to %s", e.Identity, e.Vault, e.Pinned, e.Presented)
+}
+
+// KeyPins remembers the key fingerprint first seen for every identity, per vault
+type KeyPins struct {
+	location string
+	Vaults   map[string]map[string]string `json:"vaults"`
+}
+
+// LoadKeyPins loads pinned keys from local disk. A missing file holds no pins.
+func LoadKeyPins(location string) (*KeyPins, error) {
+	pins := &KeyPins{location: location, Vaults: map[string]map[string]string{}}
+
+	content, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key pins: %v", err)
+	}
+	if err = json.Unmarshal(content, pins); err != nil {
+		return nil, fmt.Errorf("failed to parse key pins %s: %v", location, err)
+	}
+	if pins.Vaults == nil {
+		pins.Vaults = map[string]map[string]string{}
+	}
+	return pins, nil
+}
+
+// Location returns where the pins are stored
+func (p *KeyPins) Location() string {
+	return p.location
+}
+
+// Lookup returns the fingerprint pinned for an identity in a vault, if any
+func (p *KeyPins) Lookup(vault string, identity string) (string, bool) {
+	fingerprint, ok := p.Vaults[vault][strings.ToLower(identity)]
+	return fingerprint, ok
+}
+
+// Trust pins an identity in a vault to a key, replacing any previous pin
+func (p *KeyPins) Trust(vault string, identity string, fingerprint string) {
+	if p.Vaults[vault] == nil {
+		p.Vaults[vault] = map[string]string{}
+	}
+	p.Vaults[vault][strings.ToLower(identity)] = NormalizeFingerprint(fingerprint)
+}
+
+// Check makes sure all identities of a key are pinned to it. Identities seen for the
+// first time are pinned and returned, a different pinned key fails with a KeyChangedError.
+func (p *KeyPins) Check(vault string, entity *openpgp.Entity) (pinned []string, err error) {
+	fingerprint := Fingerprint(entity)
+	for _, identity := range KeyIdentities(entity) {
+		previous, ok := p.Lookup(vault, identity)
+		if !ok {
+			p.Trust(vault, identity, fingerprint)
+			pinned = append(pinned, identity)
+			continue
+		}
+		if previous != fingerprint {
+			return nil, &KeyChangedError{Vault: vault, Identity: identity, Pinned: previous, Presented: fingerprint}
+		}
+	}
+	return pinned, nil
+}
+
+// Identities lists the pinned identities of a vault
+func (p *KeyPins) Identities(vault string) []string {
+	var identities []string
+	for identity := range p.Vaults[vault] {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	return identities
+}
+
+// Save writes the pins to local disk, only readable by the owner
+func (p *KeyPins) Save() error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode key pins: %v", err)
+	}
+
+	err = writeFileAtomic(p.location, 0600, func(writer io.Writer) error {
+		_, err := writer.Write(content)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write key pins: %v", err)
+	}
+	return nil
+}
+
+// KeyIdentities returns the identities a key is pinned by: the email addresses of
+// its user IDs, or the full user ID if it has no email address
+func KeyIdentities(entity *openpgp.Entity) []string {
+	seen := map[string]bool{}
+	var identities []string
+	for name, identity := range entity.Identities {
+		if identity.UserId != nil && identity.UserId.Email != "" {
+			name = identity.UserId.Email
+		}
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			identities = append(identities, name)
+		}
+	}
+	sort.Strings(identities)
+	return identities
+}
@@ -0,0 +1,78 @@
+package tresor
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func TestKeyPinsCheck(t *testing.T) {
+	alice := testEntity(t, "Alice", "alice@example.com")
+	mallory := testEntity(t, "Mallory", "ALICE@example.com")
+	bob := testEntity(t, "Bob", "bob@example.com")
+
+	// The cases run in order against the same pins
+	tests := []struct {
+		name    string
+		vault   string
+		entity  *openpgp.Entity
+		pinned  []string
+		changed bool
+	}{
+		{"first use", "vault", alice, []string{"alice@example.com"}, false},
+		{"same key", "vault", alice, nil, false},
+		{"other identity", "vault", bob, []string{"bob@example.com"}, false},
+		{"changed key", "vault", mallory, nil, true},
+		{"other vault", "other", mallory, []string{"alice@example.com"}, false},
+		{"pinned in other vault", "other", alice, nil, true},
+	}
+
+	pins, err := LoadKeyPins(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatalf("LoadKeyPins() failed: %v", err)
+	}
+	for _, test := range tests {
+		pinned, err := pins.Check(test.vault, test.entity)
+		var changed *KeyChangedError
+		if errors.As(err, &changed) != test.changed || (err != nil && !test.changed) {
+			t.Errorf("%s: Check() error = %v, want key changed %v", test.name, err, test.changed)
+			continue
+		}
+		if !reflect.DeepEqual(pinned, test.pinned) {
+			t.Errorf("%s: Check() pinned %v, want %v", test.name, pinned, test.pinned)
+		}
+	}
+
+	// Pins survive saving and loading
+	if err = pins.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	loaded, err := LoadKeyPins(pins.Location())
+	if err != nil {
+		t.Fatalf("LoadKeyPins() failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Vaults, pins.Vaults) {
+		t.Errorf("loaded pins %v, want %v", loaded.Vaults, pins.Vaults)
+	}
+}
+
+func TestKeyIdentities(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		identities []string
+	}{
+		{"Alice", "alice@example.com", []string{"alice@example.com"}},
+		{"Bob", "Bob@Example.com", []string{"bob@example.com"}},
+		{"Carol", "", []string{"carol"}},
+	}
+	for _, test := range tests {
+		entity := testEntity(t, test.name, test.email)
+		if identities := KeyIdentities(entity); !reflect.DeepEqual(identities, test.identities) {
+			t.Errorf("KeyIdentities(%s) = %v, want %v", test.name, identities, test.identities)
+		}
+	}
+}
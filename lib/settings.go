@@ -0,0 +1,180 @@
+package tresor
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp/s2k"
+)
+
+var (
+	ciphers = map[string]packet.CipherFunction{
+		"aes128": packet.CipherAES128,
+		"aes256": packet.CipherAES256,
+	}
+	hashes = map[string]crypto.Hash{
+		"sha256":   crypto.SHA256,
+		"sha384":   crypto.SHA384,
+		"sha512":   crypto.SHA512,
+		"sha3-256": crypto.SHA3_256,
+		"sha3-512": crypto.SHA3_512,
+	}
+	compressions = map[string]packet.CompressionAlgo{
+		"none": packet.CompressionNone,
+		"zip":  packet.CompressionZIP,
+		"zlib": packet.CompressionZLIB,
+	}
+	s2kModes = map[string]s2k.Mode{
+		"iterated": s2k.IteratedSaltedS2K,
+		"argon2":   s2k.Argon2S2K,
+	}
+	hashIDs = map[crypto.Hash]uint8{
+		crypto.SHA256:   8,
+		crypto.SHA384:   9,
+		crypto.SHA512:   10,
+		crypto.SHA3_256: 12,
+		crypto.SHA3_512: 14,
+	}
+)
+
+// CryptoSettings selects the algorithms used to protect objects
+type CryptoSettings struct {
+	Cipher           string // aes128 or aes256
+	Hash             string // sha256, sha384, sha512, sha3-256 or sha3-512
+	Compression      string // none, zip or zlib
+	CompressionLevel int    // 1-9, library default if 0
+	AEAD             bool   // Use AEAD if all recipients support it
+	S2KMode          string // iterated or argon2, for passphrase-derived keys
+	S2KCount         int    // Iterations of the iterated S2K
+}
+
+// DefaultCryptoSettings returns the settings used if nothing is configured
+func DefaultCryptoSettings() *CryptoSettings {
+	return &CryptoSettings{
+		Cipher:      "aes128",
+		Hash:        "sha256",
+		Compression: "none",
+		S2KMode:     "iterated",
+	}
+}
+
+// PacketConfig converts the settings to an OpenPGP configuration
+func (s *CryptoSettings) PacketConfig() (*packet.Config, error) {
+	cipher, ok := ciphers[strings.ToLower(s.Cipher)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher: %s", s.Cipher)
+	}
+	hash, ok := hashes[strings.ToLower(s.Hash)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash: %s", s.Hash)
+	}
+	compression, ok := compressions[strings.ToLower(s.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression: %s", s.Compression)
+	}
+	mode, ok := s2kModes[strings.ToLower(s.S2KMode)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported S2K mode: %s", s.S2KMode)
+	}
+	if s.CompressionLevel < 0 || s.CompressionLevel > 9 {
+		return nil, fmt.Errorf("compression level must be between 1 and 9")
+	}
+
+	config := &packet.Config{
+		DefaultCipher:          cipher,
+		DefaultHash:            hash,
+		DefaultCompressionAlgo: compression,
+		S2KConfig: &s2k.Config{
+			S2KMode:  mode,
+			Hash:     hash,
+			S2KCount: s.S2KCount,
+		},
+	}
+	if s.CompressionLevel != 0 {
+		config.CompressionConfig = &packet.CompressionConfig{Level: s.CompressionLevel}
+	}
+	if s.AEAD {
+		config.AEADConfig = &packet.AEADConfig{}
+	}
+	return config, nil
+}
+
+// Check makes sure the recipient accepts the configured algorithms, so they are actually used
+func (s *CryptoSettings) Check(recipient *openpgp.Entity, signed bool) error {
+	config, err := s.PacketConfig()
+	if err != nil {
+		return err
+	}
+
+	selfSignature, _ := recipient.PrimarySelfSignature()
+	if selfSignature == nil {
+		return fmt.Errorf("recipient key %s has no valid self-signature", recipient.PrimaryKey.KeyIdString())
+	}
+
+	if !accepts(selfSignature.PreferredSymmetric, cipherIDs(), uint8(config.DefaultCipher), uint8(packet.CipherAES128)) {
+		return fmt.Errorf("recipient key %s does not accept cipher %s", recipient.PrimaryKey.KeyIdString(), s.Cipher)
+	}
+	if signed && !accepts(selfSignature.PreferredHash, hashIDList(), hashIDs[config.DefaultHash], hashIDs[crypto.SHA256]) {
+		return fmt.Errorf("recipient key %s does not accept hash %s", recipient.PrimaryKey.KeyIdString(), s.Hash)
+	}
+	if config.DefaultCompressionAlgo != packet.CompressionNone && !accepts(selfSignature.PreferredCompression, compressionIDs(), uint8(config.DefaultCompressionAlgo), uint8(packet.CompressionNone)) {
+		return fmt.Errorf("recipient key %s does not accept compression %s", recipient.PrimaryKey.KeyIdString(), s.Compression)
+	}
+	return nil
+}
+
+// Integrity describes the integrity protection used for a set of recipients. AEAD
+// is only used if all of them support it.
+func (s *CryptoSettings) Integrity(recipients openpgp.EntityList) string {
+	if !s.AEAD || len(recipients) == 0 {
+		return "MDC"
+	}
+	for _, recipient := range recipients {
+		selfSignature, _ := recipient.PrimarySelfSignature()
+		if selfSignature == nil || !selfSignature.SEIPDv2 {
+			return "MDC"
+		}
+	}
+	return "AEAD"
+}
+
+// accepts reports whether an algorithm is negotiated from a recipient's preferences. If none
+// of the supported candidates is preferred, the mandatory algorithm is used instead.
+func accepts(preferences []uint8, candidates []uint8, algorithm uint8, mandatory uint8) bool {
+	common := false
+	for _, preference := range preferences {
+		for _, candidate := range candidates {
+			if preference == candidate {
+				common = true
+			}
+		}
+		if preference == algorithm {
+			return true
+		}
+	}
+	return !common && algorithm == mandatory
+}
+
+func cipherIDs() (ids []uint8) {
+	for _, cipher := range ciphers {
+		ids = append(ids, uint8(cipher))
+	}
+	return ids
+}
+
+func hashIDList() (ids []uint8) {
+	for _, id := range hashIDs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func compressionIDs() (ids []uint8) {
+	for _, compression := range compressions {
+		ids = append(ids, uint8(compression))
+	}
+	return ids
+}
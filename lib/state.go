@@ -0,0 +1,203 @@
+package tresor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	// StateObject is the name of the signed state of a vault
+	StateObject = "_state"
+
+	stateReadAttempts = 5
+)
+
+// StateLeaf records one object in the state of a vault
+type StateLeaf struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Hash       string `json:"hash"` // SHA-256 of the ciphertext
+}
+
+// VaultState records all objects of a vault. The Merkle root over all leaves is signed, so added,
+// removed or changed objects can be detected by comparing the bucket against the state.
+type VaultState struct {
+	Root      string      `json:"root"`
+	Time      time.Time   `json:"time"`
+	Signer    string      `json:"signer"` // Fingerprint of the signing key
+	Leaves    []StateLeaf `json:"leaves"` // Ordered by name
+	Signature string      `json:"signature"`
+}
+
+// StateObjectName reports whether an object is part of the vault state. Objects tresor keeps for
+// itself are not.
+func StateObjectName(name string) bool {
+	return name != StateObject && name != IndexObject &&
+		!strings.HasPrefix(name, AuditLogPrefix) && !strings.HasPrefix(name, KeyDirectory)
+}
+
+// HashCiphertext hashes the stored bytes of an object
+func HashCiphertext(reader io.Reader) (string, error) {
+	digest := sha256.New()
+	if _, err := io.Copy(digest, reader); err != nil {
+		return "", fmt.Errorf("failed to hash object: %v", err)
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// Set records an object in the state, replacing a previous generation
+func (s *VaultState) Set(name string, generation int64, hash string) {
+	leaf := StateLeaf{Name: name, Generation: generation, Hash: hash}
+	i := sort.Search(len(s.Leaves), func(i int) bool { return s.Leaves[i].Name >= name })
+	if i < len(s.Leaves) && s.Leaves[i].Name == name {
+		s.Leaves[i] = leaf
+		return
+	}
+	s.Leaves = append(s.Leaves, StateLeaf{})
+	copy(s.Leaves[i+1:], s.Leaves[i:])
+	s.Leaves[i] = leaf
+}
+
+// Leaf returns the recorded generation and hash of an object
+func (s *VaultState) Leaf(name string) (StateLeaf, bool) {
+	i := sort.Search(len(s.Leaves), func(i int) bool { return s.Leaves[i].Name >= name })
+	if i < len(s.Leaves) && s.Leaves[i].Name == name {
+		return s.Leaves[i], true
+	}
+	return StateLeaf{}, false
+}
+
+// Remove forgets an object
+func (s *VaultState) Remove(name string) {
+	i := sort.Search(len(s.Leaves), func(i int) bool { return s.Leaves[i].Name >= name })
+	if i < len(s.Leaves) && s.Leaves[i].Name == name {
+		s.Leaves = append(s.Leaves[:i], s.Leaves[i+1:]...)
+	}
+}
+
+// MerkleRoot computes the root of the Merkle tree over the leaves as in RFC 6962
+func MerkleRoot(leaves []StateLeaf) string {
+	hashes := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		data := leaf.Name + "\x00" + strconv.FormatInt(leaf.Generation, 10) + "\x00" + leaf.Hash
+		digest := sha256.Sum256(append([]byte{0}, data...))
+		hashes[i] = digest[:]
+	}
+	return hex.EncodeToString(merkleTreeHash(hashes))
+}
+
+func merkleTreeHash(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		digest := sha256.Sum256(nil)
+		return digest[:]
+	case 1:
+		return hashes[0]
+	}
+	split := 1
+	for split*2 < len(hashes) {
+		split *= 2
+	}
+	node := append([]byte{1}, merkleTreeHash(hashes[:split])...)
+	digest := sha256.Sum256(append(node, merkleTreeHash(hashes[split:])...))
+	return digest[:]
+}
+
+// checkpoint serializes what is signed: the root and when and by whom it was signed
+func (s *VaultState) checkpoint() ([]byte, error) {
+	return json.Marshal(struct {
+		Root   string    `json:"root"`
+		Time   time.Time `json:"time"`
+		Signer string    `json:"signer"`
+		Size   int       `json:"size"`
+	}{s.Root, s.Time, s.Signer, len(s.Leaves)})
+}
+
+// Sign computes and signs the Merkle root of the state
+func (s *VaultState) Sign(signer *openpgp.Entity, settings *CryptoSettings) error {
+	s.Root = MerkleRoot(s.Leaves)
+	s.Time = time.Now().UTC()
+	s.Signer = Fingerprint(signer)
+
+	checkpoint, err := s.checkpoint()
+	if err != nil {
+		return fmt.Errorf("failed to encode vault state: %v", err)
+	}
+	if s.Signature, err = signDetached(signer, checkpoint, settings); err != nil {
+		return fmt.Errorf("failed to sign vault state: %v", err)
+	}
+	return nil
+}
+
+// Verify checks the leaves against the Merkle root and the signature over the root
+func (s *VaultState) Verify(ring openpgp.EntityList) (*Signature, error) {
+	if !sort.SliceIsSorted(s.Leaves, func(i, j int) bool { return s.Leaves[i].Name < s.Leaves[j].Name }) {
+		return nil, fmt.Errorf("vault state is not ordered")
+	}
+	if root := MerkleRoot(s.Leaves); root != s.Root {
+		return nil, fmt.Errorf("vault state does not match its root %s", s.Root)
+	}
+
+	checkpoint, err := s.checkpoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode vault state: %v", err)
+	}
+	signature, err := checkDetached(ring, checkpoint, s.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("vault state: %v", err)
+	}
+	if signature.Signer != nil && signature.Fingerprint() != NormalizeFingerprint(s.Signer) {
+		return nil, fmt.Errorf("vault state claims signer %s, but is signed by %s", s.Signer, signature.Identity())
+	}
+	return signature, nil
+}
+
+// ReadVaultState reads the state of a vault and the generation it is stored at. A vault
+// without state starts with an empty one at generation 0.
+func ReadVaultState(bucketName string) (*VaultState, int64, error) {
+	for attempt := 0; attempt < stateReadAttempts; attempt++ {
+		attrs, err := ReadMetadata(bucketName, StateObject, 0)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return &VaultState{}, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// The generation is gone if the state was replaced in the meantime
+		payload, err := ReadObject(bucketName, StateObject, attrs.Generation)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read vault state: %v", err)
+		}
+		state := &VaultState{}
+		if err = json.Unmarshal(payload, state); err != nil {
+			return nil, 0, fmt.Errorf("failed to parse vault state: %v", err)
+		}
+		return state, attrs.Generation, nil
+	}
+	return nil, 0, fmt.Errorf("failed to read vault state: too many concurrent changes")
+}
+
+// WriteVaultState writes the state of a vault, unless it was changed since the generation it was read at
+func WriteVaultState(bucketName string, state *VaultState, generation int64) error {
+	payload, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode vault state: %v", err)
+	}
+	_, err = WriteObjectIfGeneration(bucketName, StateObject, payload, generation)
+	return err
+}
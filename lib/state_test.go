@@ -0,0 +1,186 @@
+package tresor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func leafHash(leaf StateLeaf) []byte {
+	digest := sha256.Sum256([]byte("\x00" + leaf.Name + "\x00" + strconv.FormatInt(leaf.Generation, 10) + "\x00" + leaf.Hash))
+	return digest[:]
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	digest := sha256.Sum256(append(append([]byte{1}, left...), right...))
+	return digest[:]
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a := StateLeaf{Name: "a", Generation: 1, Hash: "aa"}
+	b := StateLeaf{Name: "b", Generation: 1, Hash: "bb"}
+	c := StateLeaf{Name: "c", Generation: 1, Hash: "cc"}
+	empty := sha256.Sum256(nil)
+
+	tests := []struct {
+		name   string
+		leaves []StateLeaf
+		root   []byte
+	}{
+		{"empty", nil, empty[:]},
+		{"one leaf", []StateLeaf{a}, leafHash(a)},
+		{"two leaves", []StateLeaf{a, b}, nodeHash(leafHash(a), leafHash(b))},
+		{"unbalanced", []StateLeaf{a, b, c}, nodeHash(nodeHash(leafHash(a), leafHash(b)), leafHash(c))},
+	}
+	for _, test := range tests {
+		if root := MerkleRoot(test.leaves); root != hex.EncodeToString(test.root) {
+			t.Errorf("%s: MerkleRoot() = %s, want %s", test.name, root, hex.EncodeToString(test.root))
+		}
+	}
+}
+
+func TestMerkleRootDetectsChanges(t *testing.T) {
+	leaves := []StateLeaf{{"a", 1, "aa"}, {"b", 1, "bb"}, {"c", 1, "cc"}}
+	root := MerkleRoot(leaves)
+
+	tests := []struct {
+		name   string
+		leaves []StateLeaf
+	}{
+		{"added", []StateLeaf{{"a", 1, "aa"}, {"b", 1, "bb"}, {"c", 1, "cc"}, {"d", 1, "dd"}}},
+		{"removed", []StateLeaf{{"a", 1, "aa"}, {"c", 1, "cc"}}},
+		{"generation", []StateLeaf{{"a", 1, "aa"}, {"b", 2, "bb"}, {"c", 1, "cc"}}},
+		{"hash", []StateLeaf{{"a", 1, "aa"}, {"b", 1, "b0"}, {"c", 1, "cc"}}},
+		{"renamed", []StateLeaf{{"a", 1, "aa"}, {"B", 1, "bb"}, {"c", 1, "cc"}}},
+		{"reordered", []StateLeaf{{"b", 1, "bb"}, {"a", 1, "aa"}, {"c", 1, "cc"}}},
+		{"name and generation shifted", []StateLeaf{{"a", 1, "aa"}, {"b\x001", 0, "bb"}, {"c", 1, "cc"}}},
+	}
+	for _, test := range tests {
+		if MerkleRoot(test.leaves) == root {
+			t.Errorf("%s: root did not change", test.name)
+		}
+	}
+}
+
+func TestVaultStateLeaves(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(state *VaultState)
+		want   []string
+	}{
+		{"set in order", func(s *VaultState) { s.Set("c", 1, "cc"); s.Set("a", 1, "aa"); s.Set("b", 1, "bb") }, []string{"a", "b", "c"}},
+		{"replace", func(s *VaultState) { s.Set("a", 1, "aa"); s.Set("a", 2, "a2") }, []string{"a"}},
+		{"remove", func(s *VaultState) { s.Set("a", 1, "aa"); s.Set("b", 1, "bb"); s.Remove("a") }, []string{"b"}},
+		{"remove missing", func(s *VaultState) { s.Set("a", 1, "aa"); s.Remove("b") }, []string{"a"}},
+	}
+	for _, test := range tests {
+		state := &VaultState{}
+		test.change(state)
+		var names []string
+		for _, leaf := range state.Leaves {
+			names = append(names, leaf.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: leaves = %v, want %v", test.name, names, test.want)
+		}
+	}
+}
+
+func TestVaultStateLeaf(t *testing.T) {
+	state := &VaultState{}
+	state.Set("a", 1, "aa")
+	state.Set("b", 1, "bb")
+	state.Set("b", 2, "b2")
+
+	tests := []struct {
+		name  string
+		found bool
+		leaf  StateLeaf
+	}{
+		{"a", true, StateLeaf{"a", 1, "aa"}},
+		{"b", true, StateLeaf{"b", 2, "b2"}},
+		{"c", false, StateLeaf{}},
+		{"", false, StateLeaf{}},
+	}
+	for _, test := range tests {
+		leaf, found := state.Leaf(test.name)
+		if found != test.found || leaf != test.leaf {
+			t.Errorf("Leaf(%q) = %v, %v, want %v, %v", test.name, leaf, found, test.leaf, test.found)
+		}
+	}
+}
+
+func TestStateObjectName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"prod/db/pw", true},
+		{StateObject, false},
+		{IndexObject, false},
+		{AuditLogPrefix + "0000000000000001", false},
+		{KeyDirectory + "ABCDEF.asc", false},
+		{"_statefile", true},
+	}
+	for _, test := range tests {
+		if got := StateObjectName(test.name); got != test.want {
+			t.Errorf("StateObjectName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVaultStateVerify(t *testing.T) {
+	alice := testEntity(t, "Alice", "alice@example.com")
+	bob := testEntity(t, "Bob", "bob@example.com")
+
+	signed := func(change func(state *VaultState)) *VaultState {
+		state := &VaultState{}
+		state.Set("a", 1, "aa")
+		state.Set("b", 1, "bb")
+		if err := state.Sign(alice, nil); err != nil {
+			t.Fatalf("Sign() failed: %v", err)
+		}
+		change(state)
+		return state
+	}
+
+	tests := []struct {
+		name    string
+		state   *VaultState
+		ring    openpgp.EntityList
+		signer  *openpgp.Entity // Expected signer, nil for unknown keys
+		message string          // Part of the expected error, empty if valid
+	}{
+		{"signed", signed(func(s *VaultState) {}), openpgp.EntityList{alice}, alice, ""},
+		{"unknown signer", signed(func(s *VaultState) {}), openpgp.EntityList{bob}, nil, ""},
+		{"leaf changed", signed(func(s *VaultState) { s.Leaves[0].Hash = "a0" }), openpgp.EntityList{alice}, nil, "does not match its root"},
+		{"leaf removed", signed(func(s *VaultState) { s.Remove("a") }), openpgp.EntityList{alice}, nil, "does not match its root"},
+		{"leaf added", signed(func(s *VaultState) { s.Set("c", 1, "cc") }), openpgp.EntityList{alice}, nil, "does not match its root"},
+		{"unordered", signed(func(s *VaultState) { s.Leaves[0], s.Leaves[1] = s.Leaves[1], s.Leaves[0] }), openpgp.EntityList{alice}, nil, "not ordered"},
+		{"root replaced", signed(func(s *VaultState) { s.Set("c", 1, "cc"); s.Root = MerkleRoot(s.Leaves) }), openpgp.EntityList{alice}, nil, "signature is invalid"},
+		{"time changed", signed(func(s *VaultState) { s.Time = s.Time.Add(-time.Hour) }), openpgp.EntityList{alice}, nil, "signature is invalid"},
+		{"signer claimed", signed(func(s *VaultState) { s.Signer = Fingerprint(bob) }), openpgp.EntityList{alice, bob}, nil, "signature is invalid"},
+	}
+	for _, test := range tests {
+		signature, err := test.state.Verify(test.ring)
+		if test.message != "" {
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%s: Verify() error = %v, want %q", test.name, err, test.message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Verify() error = %v, want none", test.name, err)
+			continue
+		}
+		if signature.Signer != test.signer {
+			t.Errorf("%s: Verify() signer = %v, want %v", test.name, signature.Signer, test.signer)
+		}
+	}
+}
@@ -3,14 +3,18 @@ package tresor
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -82,8 +86,42 @@ func ReadObject(bucketName string, key string, version int64) (payload []byte, e
 	return data, nil
 }
 
+// OpenObject opens a remote object for streaming, the caller has to close the reader
+func OpenObject(bucketName string, key string, version int64) (reader io.ReadCloser, err error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+
+	bucket := client.Bucket(bucketName)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*300)
+
+	object := bucket.Object(key)
+	if version != 0 {
+		object = object.Generation(version)
+	}
+	objectReader, err := object.NewReader(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &objectStream{Reader: objectReader, cancel: cancel}, nil
+}
+
+type objectStream struct {
+	*storage.Reader
+	cancel context.CancelFunc
+}
+
+func (s *objectStream) Close() error {
+	defer s.cancel()
+	return s.Reader.Close()
+}
+
 // ReadMetadata reads remote metadata for an object
-func ReadMetadata(bucketName string, key string) (attributes *storage.ObjectAttrs, err error) {
+func ReadMetadata(bucketName string, key string, version int64) (attributes *storage.ObjectAttrs, err error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
@@ -96,9 +134,12 @@ func ReadMetadata(bucketName string, key string) (attributes *storage.ObjectAttr
 	defer cancel()
 
 	object := bucket.Object(key)
+	if version != 0 {
+		object = object.Generation(version)
+	}
 	attrs, err := object.Attrs(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve object metadata: %v", err)
+		return nil, fmt.Errorf("failed to retrieve object metadata: %w", err)
 	}
 	return attrs, err
 }
@@ -127,6 +168,54 @@ func WriteObject(bucketName string, key string, payload []byte) (err error) {
 	return nil
 }
 
+// WriteObjectIfGeneration writes a byte sequence to remote storage only if the object is still at
+// the given generation, or does not exist yet if the generation is 0. It returns the new generation.
+func WriteObjectIfGeneration(bucketName string, key string, payload []byte, generation int64) (newGeneration int64, err error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	bucket := client.Bucket(bucketName)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*300)
+	defer cancel()
+
+	conditions := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		conditions = storage.Conditions{DoesNotExist: true}
+	}
+
+	reader := bytes.NewReader(payload)
+	writer := bucket.Object(key).If(conditions).NewWriter(ctx)
+	if _, err = io.Copy(writer, reader); err != nil {
+		return 0, fmt.Errorf("failed to copy bytes to remote storage object: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close write connection to remote storage: %w", err)
+	}
+
+	return writer.Attrs().Generation, nil
+}
+
+// IsConflict reports whether a conditional write failed because the object was changed
+func IsConflict(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// ObjectGeneration returns the current generation of an object, or 0 if it does not exist
+func ObjectGeneration(bucketName string, key string) (int64, error) {
+	attrs, err := ReadMetadata(bucketName, key, 0)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
 // WriteMetadata writes a set of tags on a remote object
 func WriteMetadata(bucketName string, key string, meta storage.ObjectAttrsToUpdate) (err error) {
 	ctx := context.Background()
@@ -146,26 +235,61 @@ func WriteMetadata(bucketName string, key string, meta storage.ObjectAttrsToUpda
 	return nil
 }
 
-// CreateMetadata create metadata to be stored along with GCS objects
-func CreateMetadata(recipient *openpgp.Entity, signer *openpgp.Entity, extension string, armored bool) storage.ObjectAttrsToUpdate {
-	signingKey := emptyMetadata
+// CreateMetadata create metadata to be stored along with GCS objects. Key IDs and file details
+// are kept in the encrypted object header instead.
+func CreateMetadata(recipients openpgp.EntityList, signer *openpgp.Entity, armored bool, settings *CryptoSettings) storage.ObjectAttrsToUpdate {
+	hash := emptyMetadata
+
+	if settings == nil {
+		settings = DefaultCryptoSettings()
+	}
 
 	if signer != nil {
-		signingKey = signer.PrimaryKey.KeyIdString()
+		hash = strings.ToUpper(settings.Hash)
+	}
+
+	return storage.ObjectAttrsToUpdate{
+		ContentType:     "application/pgp-encrypted",
+		ContentEncoding: "",
+		Metadata: map[string]string{
+			"ASCII-Armor": strconv.FormatBool(armored),
+			"Format":      FormatOpenPGP,
+			"Cipher":      strings.ToUpper(settings.Cipher),
+			"Hash":        hash,
+			"Compression": strings.ToUpper(settings.Compression),
+			"Integrity":   settings.Integrity(recipients),
+		},
 	}
+}
 
-	if extension == "" {
-		extension = emptyMetadata
+// CreateSymmetricMetadata create metadata to be stored along with GCS objects encrypted with a passphrase
+func CreateSymmetricMetadata(armored bool, settings *CryptoSettings) storage.ObjectAttrsToUpdate {
+	if settings == nil {
+		settings = DefaultCryptoSettings()
 	}
 
 	return storage.ObjectAttrsToUpdate{
 		ContentType:     "application/pgp-encrypted",
 		ContentEncoding: "",
 		Metadata: map[string]string{
-			"Signing-Key":    signingKey,
-			"Encryption-Key": recipient.PrimaryKey.KeyIdString(),
-			"File-Extension": extension,
-			"ASCII-Armor":    strconv.FormatBool(armored),
+			"ASCII-Armor": strconv.FormatBool(armored),
+			"Format":      FormatOpenPGP,
+			"Symmetric":   "true",
+			"Cipher":      strings.ToUpper(settings.Cipher),
+			"Compression": strings.ToUpper(settings.Compression),
+			"S2K":         strings.ToUpper(settings.S2KMode),
+		},
+	}
+}
+
+// CreateAgeMetadata create metadata to be stored along with GCS objects encrypted with age
+func CreateAgeMetadata(armored bool) storage.ObjectAttrsToUpdate {
+	return storage.ObjectAttrsToUpdate{
+		ContentType:     "application/age-encryption",
+		ContentEncoding: "",
+		Metadata: map[string]string{
+			"ASCII-Armor": strconv.FormatBool(armored),
+			"Format":      FormatAge,
 		},
 	}
 }
@@ -190,12 +314,12 @@ func RemoveObject(bucketName string, key string) (err error) {
 	return nil
 }
 
-// CopyObject copies a remote object to a different remote key
-func CopyObject(bucketName string, sourceKey string, destinationKey string) (err error) {
+// CopyObject copies a remote object to a different remote key and returns the generation of the copy
+func CopyObject(bucketName string, sourceKey string, destinationKey string) (generation int64, err error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create storage client: %v", err)
+		return 0, fmt.Errorf("failed to create storage client: %v", err)
 	}
 
 	bucket := client.Bucket(bucketName)
@@ -206,21 +330,22 @@ func CopyObject(bucketName string, sourceKey string, destinationKey string) (err
 	source := bucket.Object(sourceKey)
 	destination := bucket.Object(destinationKey)
 
-	if _, err := destination.CopierFrom(source).Run(ctx); err != nil {
-		return fmt.Errorf("failed copy remote objects: %v", err)
+	attrs, err := destination.CopierFrom(source).Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed copy remote objects: %v", err)
 	}
-	return nil
+	return attrs.Generation, nil
 }
 
 // CopyMetadata copies custom meta data from a remote object to another
 func CopyMetadata(bucketName string, sourceKey string, destinationKey string) error {
-	metadata, err := ReadMetadata(bucketName, sourceKey)
+	metadata, err := ReadMetadata(bucketName, sourceKey, 0)
 	if err != nil {
 		return fmt.Errorf("failed to read metadata: %v", err)
 	}
 
 	metaUpdate := storage.ObjectAttrsToUpdate{
-		ContentType:     "application/pgp-encrypted",
+		ContentType:     metadata.ContentType,
 		ContentEncoding: "",
 		Metadata:        metadata.Metadata,
 	}
@@ -0,0 +1,250 @@
+package tresor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	headerLimit = 64 * 1024
+)
+
+// SignaturePolicy describes which signatures are accepted when decrypting objects
+type SignaturePolicy struct {
+	RequireSignature bool
+	TrustedSigners   []string // Fingerprints of accepted signers, any signer if empty
+	SigningKey       string   // Signing-Key recorded in the object metadata, unchecked if empty
+}
+
+// Report describes a decrypted and verified message
+type Report struct {
+	Armored       bool
+	Recipients    []uint64 // Key IDs the message is encrypted to
+	Symmetric     bool     // Message can be decrypted with a passphrase
+	DecryptedWith uint64   // Key ID of the private key used to decrypt
+	Integrity     string   // Integrity protection of the encrypted data
+	Size          int64    // Size of the plaintext
+	Signature     *Signature
+}
+
+// Signature describes the signature found on a decrypted message
+type Signature struct {
+	Signed bool
+	KeyID  uint64
+	Signer *openpgp.Entity // nil if the signing key is unknown
+}
+
+// Fingerprint returns the fingerprint of the signer's primary key
+func (s *Signature) Fingerprint() string {
+	if s.Signer == nil {
+		return ""
+	}
+	return Fingerprint(s.Signer)
+}
+
+// Identity describes the signer in a human readable form
+func (s *Signature) Identity() string {
+	if !s.Signed {
+		return "unsigned"
+	}
+	if s.Signer == nil {
+		return fmt.Sprintf("unknown key %016X", s.KeyID)
+	}
+	return fmt.Sprintf("%s (%s)", PrimaryIdentity(s.Signer), s.Fingerprint())
+}
+
+// Verify checks a signature against the policy
+func (p *SignaturePolicy) Verify(signature *Signature) error {
+	if !signature.Signed {
+		if p.RequireSignature {
+			return fmt.Errorf("object is not signed, but a signature is required")
+		}
+		if p.SigningKey != "" && p.SigningKey != emptyMetadata {
+			return fmt.Errorf("object is not signed, but metadata claims signing key %s", p.SigningKey)
+		}
+		return nil
+	}
+
+	if signature.Signer == nil {
+		if p.RequireSignature || len(p.TrustedSigners) > 0 {
+			return fmt.Errorf("object is signed by unknown key %016X", signature.KeyID)
+		}
+	}
+
+	if p.SigningKey != "" {
+		signingKey := fmt.Sprintf("%016X", signature.KeyID)
+		if signature.Signer != nil {
+			signingKey = signature.Signer.PrimaryKey.KeyIdString()
+		}
+		if p.SigningKey == emptyMetadata {
+			return fmt.Errorf("object is signed by %s, but metadata claims it is unsigned", signature.Identity())
+		}
+		if !strings.EqualFold(signingKey, p.SigningKey) {
+			return fmt.Errorf("object is signed by %s, but metadata claims signing key %s", signature.Identity(), p.SigningKey)
+		}
+	}
+
+	if len(p.TrustedSigners) == 0 {
+		return nil
+	}
+	for _, trusted := range p.TrustedSigners {
+		if NormalizeFingerprint(trusted) == signature.Fingerprint() {
+			return nil
+		}
+	}
+	return fmt.Errorf("object is signed by untrusted key %s", signature.Identity())
+}
+
+// signDetached creates a base64 encoded detached signature over data
+func signDetached(signer *openpgp.Entity, data []byte, settings *CryptoSettings) (string, error) {
+	if settings == nil {
+		settings = DefaultCryptoSettings()
+	}
+	if key := lockedSigningKey(signer); key != nil {
+		if signature, err := agentSignDetached(signer, data, settings); err == nil {
+			return signature, nil
+		}
+		// The agent may have dropped the key since, so it is unlocked here instead
+		if _, err := unlockKey(key); err != nil {
+			return "", err
+		}
+	}
+	config, err := settings.PacketConfig()
+	if err != nil {
+		return "", err
+	}
+
+	signature := bytes.NewBuffer(nil)
+	if err = openpgp.DetachSign(signature, signer, bytes.NewReader(data), config); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature.Bytes()), nil
+}
+
+// checkDetached verifies a base64 encoded detached signature over data. Signatures by keys not
+// in the ring are reported without signer.
+func checkDetached(ring openpgp.EntityList, data []byte, encoded string) (*Signature, error) {
+	signatureBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %v", err)
+	}
+	parsed, err := packet.Read(bytes.NewReader(signatureBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signature: %v", err)
+	}
+	signaturePacket, ok := parsed.(*packet.Signature)
+	if !ok || signaturePacket.IssuerKeyId == nil {
+		return nil, fmt.Errorf("failed to parse signature: no signature with issuer")
+	}
+	signature := &Signature{Signed: true, KeyID: *signaturePacket.IssuerKeyId}
+
+	signer, err := openpgp.CheckDetachedSignature(ring, bytes.NewReader(data), bytes.NewReader(signatureBytes), nil)
+	if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		return signature, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signature is invalid: %v", err)
+	}
+	signature.Signer = signer
+	return signature, nil
+}
+
+// Fingerprint formats the fingerprint of an entity's primary key
+func Fingerprint(entity *openpgp.Entity) string {
+	return fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+}
+
+// NormalizeFingerprint strips separators and prefixes from a configured fingerprint
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(fingerprint)), "0X")
+	return strings.NewReplacer(" ", "", ":", "").Replace(fingerprint)
+}
+
+// PrimaryIdentity returns the primary user ID of an entity
+func PrimaryIdentity(entity *openpgp.Entity) string {
+	if identity := entity.PrimaryIdentity(); identity != nil {
+		return identity.Name
+	}
+	return entity.PrimaryKey.KeyIdString()
+}
+
+// lockedSigningKey returns the signing key of an entity if it is locked, because a running agent
+// signs with it
+func lockedSigningKey(signer *openpgp.Entity) *packet.PrivateKey {
+	if signer == nil {
+		return nil
+	}
+	key, ok := signer.SigningKey(time.Now())
+	if !ok || key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+		return nil
+	}
+	return key.PrivateKey
+}
+
+// headerBuffer keeps the first bytes written to it and drops the rest
+type headerBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *headerBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// integrityProtection finds the encrypted data packet and reports how it is protected
+func integrityProtection(header []byte) string {
+	reader := packet.NewReader(bytes.NewReader(header))
+	for {
+		p, err := reader.Next()
+		if err != nil {
+			return "unknown"
+		}
+		if integrity, ok := encryptedDataIntegrity(p); ok {
+			return integrity
+		}
+	}
+}
+
+// encryptedDataIntegrity reports how data is protected, if the packet is an encrypted data packet
+func encryptedDataIntegrity(p packet.Packet) (string, bool) {
+	switch encrypted := p.(type) {
+	case *packet.SymmetricallyEncrypted:
+		if !encrypted.IntegrityProtected {
+			return "none", true
+		}
+		if encrypted.Version == 2 {
+			return fmt.Sprintf("AEAD (%s)", aeadModeName(encrypted.Mode)), true
+		}
+		return "MDC", true
+	case *packet.AEADEncrypted:
+		return "AEAD", true
+	}
+	return "", false
+}
+
+func aeadModeName(mode packet.AEADMode) string {
+	switch mode {
+	case packet.AEADModeEAX:
+		return "EAX"
+	case packet.AEADModeOCB:
+		return "OCB"
+	case packet.AEADModeGCM:
+		return "GCM"
+	}
+	return fmt.Sprintf("mode %d", mode)
+}